@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"sync"
 	"time"
 )
 
@@ -13,31 +14,82 @@ type Breaker struct {
 	SuccessThreshold time.Duration // Time duration in which all operations must be succeeded after that FailCount will reset and Status will change to 'Closed'
 	OpenThreshold    time.Duration // Time duration after which Status will change to 'HalfOpen'
 	Operation        func(message interface{}) error
+	stopped          chan struct{} // closed by Stop to end the goroutine of an open breaker
+	mutex            sync.Mutex    // guards Status, FailCount and LastFail, requests, metrics and readiness use the breaker concurrently
 }
 
-func (b *Breaker) Open() {
+// State returns the status and the fail count, a breaker which is not created yet reports neither
+func (b *Breaker) State() (string, int) {
+	if b == nil {
+		return "", 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.Status, b.FailCount
+}
+
+// open must be called with the mutex held
+func (b *Breaker) open() {
+	b.Status = "Open"
 	go func() {
-		b.Status = "Open"
-		time.Sleep(b.OpenThreshold)
-		b.Status = "HalfOpen"
+		select {
+		case <-time.After(b.OpenThreshold):
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+			if b.Status == "Open" {
+				b.Status = "HalfOpen"
+			}
+		case <-b.stopped:
+		}
 	}()
 }
 
+func (b *Breaker) Open() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.open()
+}
+
+// Stop ends the background work of the breaker and refuses every later operation
+func (b *Breaker) Stop() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.stopped == nil {
+		b.stopped = make(chan struct{})
+	}
+	select {
+	case <-b.stopped:
+	default:
+		close(b.stopped)
+	}
+	b.Status = "Stopped"
+}
+
 func (b *Breaker) Do(message interface{}) error {
+	b.mutex.Lock()
+	if b.Status == "Stopped" {
+		b.mutex.Unlock()
+		return errors.New("breaker is stopped")
+	}
 	// IF Connection is OK and Fail threshold is exceeded mark connection as fail for a time for a fast fail
 	if b.Status == "Closed" && b.FailCount >= b.FailThreshold {
-		b.Open()
+		b.open()
+		b.mutex.Unlock()
 		return errors.New("fail treshold exceeded")
 	}
 	// IF connection marked as fail, return immediate error
 	if b.Status == "Open" {
+		b.mutex.Unlock()
 		return errors.New("fail treshold exceeded")
 	}
-	// DO operation and check result
+	b.mutex.Unlock()
+	// DO operation and check result, without the mutex as publishing waits for the network
 	err := b.Operation(message)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	if err != nil {
 		if b.Status == "HalfOpen" {
-			b.Open()
+			b.open()
 		} else {
 			b.FailCount++
 		}
@@ -47,19 +99,26 @@ func (b *Breaker) Do(message interface{}) error {
 	// IF connection is marked as Healthy or halfHealthy check for Last Failed time
 	if b.Status == "HalfOpen" || b.Status == "Closed" {
 		if time.Since(b.LastFail) >= b.SuccessThreshold {
-			b.Close()
+			b.close()
 		}
 	}
 	return nil
 }
 
-func (b *Breaker) Close() {
+// close must be called with the mutex held
+func (b *Breaker) close() {
 	b.Status = "Closed"
 	b.FailCount = 0
 }
 
-func GetBreakerOverloadInstance(Func func(message interface{}) error) Breaker {
-	b := Breaker{}
+func (b *Breaker) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.close()
+}
+
+func GetBreakerOverloadInstance(Func func(message interface{}) error) *Breaker {
+	b := &Breaker{}
 	b.Status = "Closed"
 	b.OpenThreshold = 30 * time.Second
 	b.FailCount = 0
@@ -67,5 +126,6 @@ func GetBreakerOverloadInstance(Func func(message interface{}) error) Breaker {
 	b.LastFail = time.Now()
 	b.SuccessThreshold = 1 * time.Minute
 	b.Operation = Func
+	b.stopped = make(chan struct{})
 	return b
 }
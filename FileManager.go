@@ -1,25 +1,52 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 )
 
 type FileManager struct {
+	Name                 string // used as the store label of storage metrics
 	config               interface{}
+	ctx                  context.Context
 	GetFunction          func(filter interface{}, config interface{}) ([]byte, error)
+	GetPageFunction      func(filter interface{}, findOptions FindOptions, config interface{}) ([]byte, int64, error)
 	UpdateFunction       func(filter interface{}, update interface{}, config interface{}) error
+	UpdateManyFunction   func(filter interface{}, update interface{}, config interface{}) error
 	UpdateAndGetFunction func(filter interface{}, update interface{}, config interface{}) ([]byte, error)
 	InsertFunction       func(insert interface{}, config interface{}) error
 	DeleteFunction       func(filter interface{}, config interface{}) error
+	DeleteManyFunction   func(filter interface{}, config interface{}) error
+	ApplyFunction        func(operations []DocOperation, config interface{}) error
+	IndexFunction        func(keys interface{}, unique bool, config interface{}) error
+	DropIndexFunction    func(keys interface{}, config interface{}) error
 	SendMessageFunction  func(message interface{}, configParams interface{}) error
 }
 
+// WithContext returns a copy of the file manager whose storage spans are children of the span in ctx
+func (f FileManager) WithContext(ctx context.Context) FileManager {
+	f.ctx = ctx
+	return f
+}
+
+func (f FileManager) context() context.Context {
+	if f.ctx == nil {
+		return context.Background()
+	}
+	return f.ctx
+}
+
 func (f FileManager) Get(filter interface{}) ([]bson.M, error) {
+	start := time.Now()
+	span := startStorageSpan(f.context(), f.Name, "Get")
 	bytes, err := f.GetFunction(filter, f.config)
+	ObserveStorage(f.Name, "Get", start, err)
+	endSpan(span, err)
 	if err != nil {
-		return nil, err
+		return nil, StorageError(err)
 	}
 	result := []bson.M{}
 	err = json.Unmarshal(bytes, &result)
@@ -29,47 +56,147 @@ func (f FileManager) Get(filter interface{}) ([]bson.M, error) {
 	return result, nil
 }
 
+func (f FileManager) GetPage(filter interface{}, findOptions FindOptions) ([]bson.M, int64, error) {
+	start := time.Now()
+	span := startStorageSpan(f.context(), f.Name, "GetPage")
+	bytes, total, err := f.GetPageFunction(filter, findOptions, f.config)
+	ObserveStorage(f.Name, "GetPage", start, err)
+	endSpan(span, err)
+	if err != nil {
+		return nil, 0, StorageError(err)
+	}
+	result := []bson.M{}
+	err = json.Unmarshal(bytes, &result)
+	if err != nil {
+		return nil, 0, err
+	}
+	return result, total, nil
+}
+
 func (f FileManager) GetOne(filter interface{}) (bson.M, error) {
+	start := time.Now()
+	span := startStorageSpan(f.context(), f.Name, "Get")
 	bytes, err := f.GetFunction(filter, f.config)
+	ObserveStorage(f.Name, "Get", start, err)
+	endSpan(span, err)
 	if err != nil {
-		return nil, err
+		return nil, StorageError(err)
 	}
 	result := []bson.M{}
 	err = json.Unmarshal(bytes, &result)
 	if err != nil {
 		return nil, err
 	}
+	if len(result) == 0 {
+		return nil, ErrNotFound
+	}
 	return result[0], nil
 }
 
 func (f FileManager) Update(filter interface{}, update interface{}) error {
+	start := time.Now()
+	span := startStorageSpan(f.context(), f.Name, "Update")
 	err := f.UpdateFunction(filter, update, f.config)
+	ObserveStorage(f.Name, "Update", start, err)
+	endSpan(span, err)
+	if err != nil {
+		return StorageError(err)
+	}
+	return nil
+}
+
+func (f FileManager) UpdateMany(filter interface{}, update interface{}) error {
+	start := time.Now()
+	span := startStorageSpan(f.context(), f.Name, "UpdateMany")
+	err := f.UpdateManyFunction(filter, update, f.config)
+	ObserveStorage(f.Name, "UpdateMany", start, err)
+	endSpan(span, err)
 	if err != nil {
-		return err
+		return StorageError(err)
 	}
 	return nil
 }
 
 func (f FileManager) Insert(insert interface{}) error {
+	start := time.Now()
+	span := startStorageSpan(f.context(), f.Name, "Insert")
 	err := f.InsertFunction(insert, f.config)
+	ObserveStorage(f.Name, "Insert", start, err)
+	endSpan(span, err)
 	if err != nil {
-		return err
+		return StorageError(err)
 	}
 	return nil
 }
 
 func (f FileManager) Delete(filter interface{}) error {
+	start := time.Now()
+	span := startStorageSpan(f.context(), f.Name, "Delete")
 	err := f.DeleteFunction(filter, f.config)
+	ObserveStorage(f.Name, "Delete", start, err)
+	endSpan(span, err)
 	if err != nil {
-		return err
+		return StorageError(err)
+	}
+	return nil
+}
+
+func (f FileManager) DeleteMany(filter interface{}) error {
+	start := time.Now()
+	span := startStorageSpan(f.context(), f.Name, "DeleteMany")
+	err := f.DeleteManyFunction(filter, f.config)
+	ObserveStorage(f.Name, "DeleteMany", start, err)
+	endSpan(span, err)
+	if err != nil {
+		return StorageError(err)
+	}
+	return nil
+}
+
+func (f FileManager) Apply(operations []DocOperation) error {
+	start := time.Now()
+	span := startStorageSpan(f.context(), f.Name, "Apply")
+	err := f.ApplyFunction(operations, f.config)
+	ObserveStorage(f.Name, "Apply", start, err)
+	endSpan(span, err)
+	if err != nil {
+		return StorageError(err)
+	}
+	return nil
+}
+
+func (f FileManager) EnsureIndex(keys interface{}, unique bool) error {
+	start := time.Now()
+	span := startStorageSpan(f.context(), f.Name, "Index")
+	err := f.IndexFunction(keys, unique, f.config)
+	ObserveStorage(f.Name, "Index", start, err)
+	endSpan(span, err)
+	if err != nil {
+		return StorageError(err)
+	}
+	return nil
+}
+
+func (f FileManager) DropIndex(keys interface{}) error {
+	start := time.Now()
+	span := startStorageSpan(f.context(), f.Name, "DropIndex")
+	err := f.DropIndexFunction(keys, f.config)
+	ObserveStorage(f.Name, "DropIndex", start, err)
+	endSpan(span, err)
+	if err != nil {
+		return StorageError(err)
 	}
 	return nil
 }
 
 func (f FileManager) UpdateAndGet(filter interface{}, update interface{}) (bson.M, error) {
+	start := time.Now()
+	span := startStorageSpan(f.context(), f.Name, "UpdateAndGet")
 	bytes, err := f.UpdateAndGetFunction(filter, update, f.config)
+	ObserveStorage(f.Name, "UpdateAndGet", start, err)
+	endSpan(span, err)
 	if err != nil {
-		return nil, err
+		return nil, StorageError(err)
 	}
 	result := bson.M{}
 	err = json.Unmarshal(bytes, &result)
@@ -88,10 +215,16 @@ func GetFileManagerDefaultInstace(conf interface{}) FileManager {
 	fm := FileManager{
 		config:               conf,
 		GetFunction:          GetDoc,
+		GetPageFunction:      GetDocPage,
 		InsertFunction:       AddDoc,
 		UpdateFunction:       SetDoc,
+		UpdateManyFunction:   SetDocs,
 		UpdateAndGetFunction: SetGetDoc,
 		DeleteFunction:       RemoveDoc,
+		DeleteManyFunction:   RemoveDocs,
+		ApplyFunction:        ApplyDocs,
+		IndexFunction:        AddIndex,
+		DropIndexFunction:    RemoveIndex,
 		SendMessageFunction:  SendMessage,
 	}
 	return fm
@@ -100,20 +233,32 @@ func GetFileManagerDefaultInstace(conf interface{}) FileManager {
 func GetFileManagerOverloadInstace(
 	conf interface{},
 	getFunction func(filter interface{}, config interface{}) ([]byte, error),
+	getPageFunction func(filter interface{}, findOptions FindOptions, config interface{}) ([]byte, int64, error),
 	insertFunction func(intert interface{}, config interface{}) error,
 	updateFunction func(filter interface{}, update interface{}, config interface{}) error,
+	updateManyFunction func(filter interface{}, update interface{}, config interface{}) error,
 	updateandGetFunction func(filter interface{}, update interface{}, config interface{}) ([]byte, error),
 	deleteFunction func(filter interface{}, config interface{}) error,
+	deleteManyFunction func(filter interface{}, config interface{}) error,
+	applyFunction func(operations []DocOperation, config interface{}) error,
+	indexFunction func(keys interface{}, unique bool, config interface{}) error,
+	dropIndexFunction func(keys interface{}, config interface{}) error,
 	sendMessageFunction func(message interface{}, confParams interface{}) error,
 
 ) FileManager {
 	fm := FileManager{
 		config:               conf,
 		GetFunction:          getFunction,
+		GetPageFunction:      getPageFunction,
 		InsertFunction:       insertFunction,
 		UpdateFunction:       updateFunction,
+		UpdateManyFunction:   updateManyFunction,
 		UpdateAndGetFunction: updateandGetFunction,
 		DeleteFunction:       deleteFunction,
+		DeleteManyFunction:   deleteManyFunction,
+		ApplyFunction:        applyFunction,
+		IndexFunction:        indexFunction,
+		DropIndexFunction:    dropIndexFunction,
 		SendMessageFunction:  sendMessageFunction,
 	}
 	return fm
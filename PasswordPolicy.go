@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type PasswordPolicy struct {
+	MinLength        int             // Minimum password length
+	MaxLength        int             // Maximum password length, 0 means unlimited
+	RequireLower     bool            // Password must contain a small letter
+	RequireUpper     bool            // Password must contain a capital letter
+	RequireDigit     bool            // Password must contain a digit
+	RequireSymbol    bool            // Password must contain a non alphanumeric character
+	DisallowUsername bool            // Password must not contain the account name
+	Blocklist        map[string]bool // Lowercased common passwords which are not allowed
+	MaxAge           time.Duration   // Time after which password expires, 0 means never
+	HistorySize      int             // Count of previous password hashes which cannot be reused
+}
+
+func (p PasswordPolicy) Check(password string, username string) []string {
+	failed := []string{}
+	length := len([]rune(password))
+	if length < p.MinLength {
+		failed = append(failed, fmt.Sprintf("password must be at least %d characters long", p.MinLength))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		failed = append(failed, fmt.Sprintf("password must be at most %d characters long", p.MaxLength))
+	}
+	hasLower, hasUpper, hasDigit, hasSymbol := false, false, false, false
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		default:
+			hasSymbol = true
+		}
+	}
+	if p.RequireLower && !hasLower {
+		failed = append(failed, "password must contain a small letter")
+	}
+	if p.RequireUpper && !hasUpper {
+		failed = append(failed, "password must contain a capital letter")
+	}
+	if p.RequireDigit && !hasDigit {
+		failed = append(failed, "password must contain a digit")
+	}
+	if p.RequireSymbol && !hasSymbol {
+		failed = append(failed, "password must contain a special character")
+	}
+	if p.DisallowUsername && username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		failed = append(failed, "password must not contain the user name")
+	}
+	if p.Blocklist[strings.ToLower(password)] {
+		failed = append(failed, "password is too common")
+	}
+	return failed
+}
+
+// IsExpired tells whether the password must be changed before the account is used, a password of unknown age is expired
+// once MaxAge is set. Migration 7 dates the passwords stored before PasswordCreated existed
+func (p PasswordPolicy) IsExpired(account bson.M) bool {
+	if mustChange, ok := account["MustChangePassword"].(bool); ok && mustChange {
+		return true
+	}
+	if p.MaxAge == 0 {
+		return false
+	}
+	created, ok := account["PasswordCreated"].(string)
+	if !ok {
+		return true
+	}
+	createdTime, err := time.Parse(time.RFC3339Nano, created)
+	if err != nil || createdTime.IsZero() {
+		return true
+	}
+	return time.Since(createdTime) >= p.MaxAge
+}
+
+func (p PasswordPolicy) IsReused(account bson.M, hash string) bool {
+	if account["Password"] == hash {
+		return true
+	}
+	for _, old := range p.History(account) {
+		if old == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// History returns the stored previous password hashes of an account, newest first, limited to HistorySize
+func (p PasswordPolicy) History(account bson.M) []string {
+	history := []string{}
+	stored, _ := account["PasswordHistory"].([]interface{})
+	for _, value := range stored {
+		if len(history) >= p.HistorySize {
+			break
+		}
+		if hash, ok := value.(string); ok {
+			history = append(history, hash)
+		}
+	}
+	return history
+}
+
+// NextHistory returns the password history to store when the current password of an account is replaced
+func (p PasswordPolicy) NextHistory(account bson.M) []string {
+	history := []string{}
+	if current, ok := account["Password"].(string); ok && p.HistorySize > 0 {
+		history = append(history, current)
+	}
+	history = append(history, p.History(account)...)
+	if len(history) > p.HistorySize {
+		history = history[:p.HistorySize]
+	}
+	return history
+}
+
+func LoadPasswordBlocklist(path string) (map[string]bool, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	blocklist := map[string]bool{}
+	for _, line := range strings.Split(string(bytes), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		blocklist[strings.ToLower(line)] = true
+	}
+	return blocklist, nil
+}
+
+func GetPasswordPolicyDefaultInstance() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:        8,
+		RequireLower:     true,
+		RequireUpper:     true,
+		RequireDigit:     true,
+		DisallowUsername: true,
+		Blocklist:        map[string]bool{},
+	}
+}
+
+func getPasswordPolicyEnvs() (PasswordPolicy, error) {
+	policy := GetPasswordPolicyDefaultInstance()
+	maxAgeDays := 0
+	intEnvs := map[string]*int{
+		"pwdMinLength":   &policy.MinLength,
+		"pwdMaxLength":   &policy.MaxLength,
+		"pwdHistorySize": &policy.HistorySize,
+		"pwdMaxAgeDays":  &maxAgeDays,
+	}
+	for name, target := range intEnvs {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return policy, fmt.Errorf("environment variable %s must be a non negative number", strings.ToLower(name))
+		}
+		*target = number
+	}
+	boolEnvs := map[string]*bool{
+		"pwdRequireLower":     &policy.RequireLower,
+		"pwdRequireUpper":     &policy.RequireUpper,
+		"pwdRequireDigit":     &policy.RequireDigit,
+		"pwdRequireSymbol":    &policy.RequireSymbol,
+		"pwdDisallowUsername": &policy.DisallowUsername,
+	}
+	for name, target := range boolEnvs {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		flag, err := strconv.ParseBool(value)
+		if err != nil {
+			return policy, fmt.Errorf("environment variable %s must be true or false", strings.ToLower(name))
+		}
+		*target = flag
+	}
+	policy.MaxAge = time.Duration(maxAgeDays) * 24 * time.Hour
+	if policy.MaxLength > 0 && policy.MaxLength < policy.MinLength {
+		return policy, fmt.Errorf("pwdmaxlength cannot be less than pwdminlength")
+	}
+	if path := os.Getenv("pwdBlocklist"); path != "" {
+		blocklist, err := LoadPasswordBlocklist(path)
+		if err != nil {
+			return policy, err
+		}
+		policy.Blocklist = blocklist
+	}
+	return policy, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var adminCommands = map[string]func(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int{
+	"bootstrap-admin":    bootstrapAdmin,
+	"reset-password":     resetPassword,
+	"validate-config":    validateConfig,
+	"migrate":            migrate,
+	"check-connectivity": checkConnectivity,
+}
+
+// RunCommand runs admin commands against the configured databases directly, any other command is sent to the API by the client
+func RunCommand(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	if command, ok := adminCommands[args[0]]; ok {
+		return command(args[1:], stdin, stdout, stderr)
+	}
+	return RunClient(args, stdin, stdout, stderr)
+}
+
+func loadAdminConfig(stderr io.Writer) bool {
+	if err := getEnvs(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return false
+	}
+	initFileManagers()
+	return true
+}
+
+func bootstrapAdmin(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("bootstrap-admin", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage: bootstrap-admin NAME")
+		return exitUsage
+	}
+	if !loadAdminConfig(stderr) {
+		return exitError
+	}
+	name := flags.Arg(0)
+	admins, err := UserFM.Get(bson.M{"Team": SystemTeam})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUnavailable
+	}
+	if len(admins) > 0 {
+		fmt.Fprintf(stderr, "%s team already has users, use reset-password or the API to manage them\n", SystemTeam)
+		return exitConflict
+	}
+	password, err := readPassword(stdin, stderr, "Password: ")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	if failed := GlobalConfig.PasswordPolicy.Check(password, name); len(failed) > 0 {
+		fmt.Fprintln(stderr, PasswordPolicyMessage(failed))
+		return exitInvalid
+	}
+	admin := Account{
+		Team:            SystemTeam,
+		Name:            name,
+		Password:        GetHash(password),
+		PasswordCreated: time.Now(),
+		PasswordHistory: []string{},
+	}
+	if err := UserFM.Insert(admin); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUnavailable
+	}
+	fmt.Fprintf(stdout, "user %s added to %s team\n", name, SystemTeam)
+	return exitOK
+}
+
+func resetPassword(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("reset-password", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	mustChange := flags.Bool("must-change", true, "force the user to change the password at next login")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage: reset-password [-must-change=false] NAME")
+		return exitUsage
+	}
+	if !loadAdminConfig(stderr) {
+		return exitError
+	}
+	name := flags.Arg(0)
+	filter := bson.M{"Name": name}
+	storedUser, err := UserFM.GetOne(filter)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			fmt.Fprintf(stderr, "no user found with name: %s\n", name)
+			return exitNotFound
+		}
+		fmt.Fprintln(stderr, err)
+		return exitUnavailable
+	}
+	password, err := readPassword(stdin, stderr, "New password: ")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	if failed := GlobalConfig.PasswordPolicy.Check(password, name); len(failed) > 0 {
+		fmt.Fprintln(stderr, PasswordPolicyMessage(failed))
+		return exitInvalid
+	}
+	update := bson.D{
+		{Key: "$set", Value: bson.M{
+			"Password":           GetHash(password),
+			"PasswordCreated":    time.Now(),
+			"PasswordHistory":    GlobalConfig.PasswordPolicy.NextHistory(storedUser),
+			"MustChangePassword": *mustChange,
+		}},
+	}
+	if err := UserFM.Update(filter, update); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUnavailable
+	}
+	fmt.Fprintf(stdout, "password of %s was reset\n", name)
+	return exitOK
+}
+
+func validateConfig(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	if len(args) != 0 {
+		fmt.Fprintln(stderr, "usage: validate-config")
+		return exitUsage
+	}
+	if err := getEnvs(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	databases := append([]DBConfig{}, GlobalConfig.DBConf...)
+	databases = append(databases, GlobalConfig.TeamDBConf, GlobalConfig.AuditDBConf, GlobalConfig.RevisionDBConf, GlobalConfig.MigrationDBConf)
+	for _, conf := range databases {
+		fmt.Fprintf(stdout, "collection: %s.%s\n", conf.Database, conf.Collection)
+	}
+	fmt.Fprintf(stdout, "queue: %s\n", GlobalConfig.QName)
+	fmt.Fprintf(stdout, "log level: %s\n", GlobalConfig.LogLevel)
+	fmt.Fprintf(stdout, "traces exporter: %s\n", GlobalConfig.TracesExporter)
+	fmt.Fprintf(stdout, "drain timeout: %s\n", GlobalConfig.DrainTimeout)
+	fmt.Fprintf(stdout, "pre-stop delay: %s\n", GlobalConfig.PreStopDelay)
+	fmt.Fprintf(stdout, "secrets refresh interval: %s\n", GlobalConfig.SecretsRefresh)
+	if GlobalConfig.TLS.Enabled() {
+		if _, err := NewTLSConfig(GlobalConfig.TLS); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		fmt.Fprintf(stdout, "tls: %s, minimum version %s, client certificates %s\n", GlobalConfig.TLS.CertFile, tls.VersionName(GlobalConfig.TLS.MinVersion), clientCertMode(GlobalConfig.TLS))
+	} else {
+		fmt.Fprintln(stdout, "tls: disabled")
+	}
+	policy := GlobalConfig.PasswordPolicy
+	fmt.Fprintf(stdout, "password policy: length %d-%d, history %d, max age %s, blocklist %d entries\n", policy.MinLength, policy.MaxLength, policy.HistorySize, policy.MaxAge, len(policy.Blocklist))
+	fmt.Fprintln(stdout, "configuration is valid")
+	return exitOK
+}
+
+func migrate(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	status := flags.Bool("status", false, "only list migrations and whether they are applied")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		fmt.Fprintln(stderr, "usage: migrate [-status]")
+		return exitUsage
+	}
+	if !loadAdminConfig(stderr) {
+		return exitError
+	}
+	if *status {
+		applied, err := GetAppliedMigrations()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUnavailable
+		}
+		for _, migration := range Migrations {
+			state := "pending"
+			if _, ok := applied[migration.Version]; ok {
+				state = "applied"
+			}
+			fmt.Fprintf(stdout, "%d\t%s\t%s\n", migration.Version, state, migration.Description)
+		}
+		return exitOK
+	}
+	if err := RunMigrations(stdout); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUnavailable
+	}
+	return exitOK
+}
+
+func checkConnectivity(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	if len(args) != 0 {
+		fmt.Fprintln(stderr, "usage: check-connectivity")
+		return exitUsage
+	}
+	if err := getEnvs(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	code := exitOK
+	for _, conf := range GlobalConfig.DBConf {
+		if err := ValidateDBConfig(conf); err != nil {
+			fmt.Fprintf(stdout, "database %s.%s: FAIL %s\n", conf.Database, conf.Collection, err)
+			code = exitUnavailable
+			continue
+		}
+		fmt.Fprintf(stdout, "database %s.%s: OK\n", conf.Database, conf.Collection)
+	}
+	if err := CheckQueue(getCommonConfig(GlobalConfig.DBConf[0])); err != nil {
+		fmt.Fprintf(stdout, "queue %s: FAIL %s\n", GlobalConfig.QName, err)
+		code = exitUnavailable
+	} else {
+		fmt.Fprintf(stdout, "queue %s: OK\n", GlobalConfig.QName)
+	}
+	return code
+}
+
+func clientCertMode(conf tlsconfig) string {
+	switch {
+	case conf.RequireClientCert:
+		return "required"
+	case conf.ClientCAFile != "":
+		return "optional"
+	}
+	return "disabled"
+}
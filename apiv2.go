@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The /api/2 routes identify resources by their path and answer with the resource itself, 201 on creation and 204 on removal.
+// They share validation, storage, revisions, audit and change events with /api/1, errors are the same httpresponse bodies
+
+type configpage struct {
+	Items []TeamConfig
+	Total int64
+	Page  int64
+	Limit int64
+}
+
+type userpage struct {
+	Items []ApiUser
+	Total int64
+	Page  int64
+	Limit int64
+}
+
+func configLocation(team string, name interface{}) string {
+	return fmt.Sprintf("/api/2/teams/%s/configs/%s", url.PathEscape(team), url.PathEscape(fmt.Sprint(name)))
+}
+
+// TeamAccess lets users reach the configurations of their own team and system users those of every team,
+// the Team param set by Authenticate is replaced by the team of the path
+func TeamAccess(c *gin.Context) {
+	team := c.Params.ByName("team")
+	if c.Params.ByName("Team") != team && c.Params.ByName("isAuthorized") == "false" {
+		RespondError(c, ErrForbidden, "Not authorized")
+		return
+	}
+	for i := range c.Params {
+		if c.Params[i].Key == "Team" {
+			c.Params[i].Value = team
+		}
+	}
+}
+
+// respondConfig writes the stored configuration as a TeamConfig
+func respondConfig(c *gin.Context, status int, config bson.M) {
+	teamconfigs, err := ConverttoTeamConfigs([]bson.M{config})
+	if err != nil {
+		RespondError(c, err, "")
+		return
+	}
+	c.IndentedJSON(status, teamconfigs[0])
+}
+
+// ListConfigsV2 answers without an ETag like GetmyConfig, the Revision of each item is its ETag
+func ListConfigsV2(c *gin.Context) {
+	team := c.Params.ByName("Team")
+	page, limit, err := GetPagination(c)
+	if err != nil {
+		RespondError(c, Invalid(err), fmt.Sprint(err))
+		return
+	}
+	findOptions := FindOptions{Skip: (page - 1) * limit, Limit: limit, Sort: bson.D{{Key: "Name", Value: 1}}}
+	configs, total, err := ConfigFM.WithContext(RequestContext(c)).GetPage(bson.M{"Team": team}, findOptions)
+	if err != nil {
+		RespondError(c, fmt.Errorf("GetTeamConfigs: %w", err), "")
+		return
+	}
+	teamconfigs, err := ConverttoTeamConfigs(configs)
+	if err != nil {
+		RespondError(c, err, "")
+		return
+	}
+	c.IndentedJSON(200, configpage{Items: teamconfigs, Total: total, Page: page, Limit: limit})
+}
+
+func AddConfigV2(c *gin.Context) {
+	team := c.Params.ByName("Team")
+	configM := bson.M{}
+	if err := c.ShouldBindJSON(&configM); err != nil {
+		RespondError(c, Invalid(err), "post body must be in json format")
+		return
+	}
+	config, message, err := CreateConfig(c, team, configM)
+	if err != nil {
+		RespondError(c, err, message)
+		return
+	}
+	c.Header("Location", configLocation(team, config["Name"]))
+	respondConfig(c, 201, config)
+}
+
+func SetConfigV2(c *gin.Context) {
+	team := c.Params.ByName("Team")
+	name := c.Params.ByName("name")
+	configM := bson.M{}
+	if err := c.ShouldBindJSON(&configM); err != nil {
+		RespondError(c, Invalid(err), "put body must be in json format")
+		return
+	}
+	configM["Team"] = team
+	config, _, message, err := UpdateConfig(c, team, bson.M{"Team": team, "Name": name}, configM)
+	if err != nil {
+		RespondError(c, err, message)
+		return
+	}
+	if config["Name"] != name {
+		c.Header("Location", configLocation(team, config["Name"]))
+	}
+	respondConfig(c, 200, config)
+}
+
+func RemoveConfigV2(c *gin.Context) {
+	team := c.Params.ByName("Team")
+	name := c.Params.ByName("name")
+	message, err := DeleteConfig(c, team, bson.M{"Team": team, "Name": name}, bson.M{"Team": team, "Name": name})
+	if err != nil {
+		RespondError(c, err, message)
+		return
+	}
+	c.Status(204)
+}
+
+func ListUsersV2(c *gin.Context) {
+	list, message, err := ListUsers(c)
+	if err != nil {
+		RespondError(c, err, message)
+		return
+	}
+	c.IndentedJSON(200, userpage{Items: list.Users, Total: list.Total, Page: list.Page, Limit: list.Limit})
+}
+
+func AddUserV2(c *gin.Context) {
+	if c.Params.ByName("isAuthorized") == "false" {
+		RespondError(c, ErrForbidden, "Not authorized")
+		return
+	}
+	user := bson.M{}
+	if err := c.ShouldBindJSON(&user); err != nil {
+		RespondError(c, Invalid(err), "post body must be in json format")
+		return
+	}
+	if message, err := CreateUser(c, user); err != nil {
+		RespondError(c, err, message)
+		return
+	}
+	apiUsers, err := ConverttoApiUsers([]bson.M{user})
+	if err != nil {
+		RespondError(c, err, "")
+		return
+	}
+	c.Header("Location", "/api/2/users/"+url.PathEscape(apiUsers[0].Name))
+	c.IndentedJSON(201, apiUsers[0])
+}
+
+func SetUserV2(c *gin.Context) {
+	user := bson.M{}
+	if err := c.ShouldBindJSON(&user); err != nil {
+		RespondError(c, Invalid(err), "put body must be in json format")
+		return
+	}
+	user["Name"] = c.Params.ByName("name")
+	if _, message, err := UpdateUser(c, user); err != nil {
+		RespondError(c, err, message)
+		return
+	}
+	c.Status(204)
+}
+
+func RemoveUserV2(c *gin.Context) {
+	if c.Params.ByName("isAuthorized") == "false" {
+		RespondError(c, ErrForbidden, "Not authorized")
+		return
+	}
+	if message, err := DeleteUser(c, c.Params.ByName("name")); err != nil {
+		RespondError(c, err, message)
+		return
+	}
+	c.Status(204)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var AuditFM FileManager
+
+type FieldChange struct {
+	Before interface{} `bson:"Before" json:"Before"`
+	After  interface{} `bson:"After" json:"After"`
+}
+
+type AuditEntry struct {
+	Actor    string                 `bson:"Actor" json:"Actor"`
+	Team     string                 `bson:"Team" json:"Team"`
+	Action   string                 `bson:"Action" json:"Action"`
+	Target   string                 `bson:"Target" json:"Target"`
+	Outcome  string                 `bson:"Outcome" json:"Outcome"`
+	Status   int                    `bson:"Status" json:"Status"`
+	Changes  map[string]FieldChange `bson:"Changes" json:"Changes"`
+	ClientIP string                 `bson:"ClientIP" json:"ClientIP"`
+	Time     time.Time              `bson:"Time" json:"Time"`
+}
+
+type auditlist struct {
+	Entries []AuditEntry
+	Total   int64
+	Page    int64
+	Limit   int64
+}
+
+// Technical fields which are not part of the document state
+var auditIgnored = map[string]bool{"_id": true, "UpdateType": true, "UpdateTime": true, "Revision": true, "ID": true}
+
+func DocumentDiff(before bson.M, after bson.M) map[string]FieldChange {
+	changes := map[string]FieldChange{}
+	keys := map[string]bool{}
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range after {
+		keys[key] = true
+	}
+	for key := range keys {
+		if auditIgnored[key] {
+			continue
+		}
+		oldValue, hadOld := before[key]
+		newValue, hasNew := after[key]
+		if hadOld && hasNew && reflect.DeepEqual(normalizeAuditValue(oldValue), normalizeAuditValue(newValue)) {
+			continue
+		}
+		if redactedFields[key] {
+			oldValue, newValue = nil, nil
+			if hadOld {
+				oldValue = "<redacted>"
+			}
+			if hasNew {
+				newValue = "<redacted>"
+			}
+		}
+		changes[key] = FieldChange{Before: oldValue, After: newValue}
+	}
+	return changes
+}
+
+// normalizeAuditValue brings values to their json representation so stored and requested documents compare equally
+func normalizeAuditValue(value interface{}) interface{} {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var result interface{}
+	if err := json.Unmarshal(bytes, &result); err != nil {
+		return value
+	}
+	return result
+}
+
+// SetAuditChange stores target and document states on the request for the Audit middleware
+func SetAuditChange(c *gin.Context, target string, before bson.M, after bson.M) {
+	c.Set("auditTarget", target)
+	c.Set("auditBefore", before)
+	c.Set("auditAfter", after)
+}
+
+func Audit(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		status := c.Writer.Status()
+		// A stored change is audited even if a later step like publishing has failed
+		_, changed := c.Get("auditTarget")
+		outcome := ""
+		switch {
+		case status == 401 || status == 403:
+			outcome = "Denied"
+		case changed || (status >= 200 && status < 300):
+			outcome = "Success"
+		default:
+			return
+		}
+		actor := GetUserName(c)
+		entry := AuditEntry{
+			Actor:    actor,
+			Team:     c.Params.ByName("Team"),
+			Action:   action,
+			Target:   c.GetString("auditTarget"),
+			Outcome:  outcome,
+			Status:   status,
+			Changes:  map[string]FieldChange{},
+			ClientIP: c.ClientIP(),
+			Time:     time.Now(),
+		}
+		before, _ := c.Get("auditBefore")
+		after, _ := c.Get("auditAfter")
+		beforeM, _ := before.(bson.M)
+		afterM, _ := after.(bson.M)
+		if outcome == "Success" {
+			entry.Changes = DocumentDiff(beforeM, afterM)
+		}
+		if err := AuditFM.WithContext(RequestContext(c)).Insert(entry); err != nil {
+			RequestLogger(c).Error("cannot store audit entry", "stage", "AddAuditEntry", "error", err)
+		}
+	}
+}
+
+func ConverttoAuditEntries(in interface{}) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	bytes, err := json.Marshal(in)
+	if err != nil {
+		return entries, err
+	}
+	err = json.Unmarshal(bytes, &entries)
+	if err != nil {
+		return entries, err
+	}
+	return entries, err
+}
+
+func GetAuditFilter(c *gin.Context) (bson.M, error) {
+	filter := bson.M{}
+	fields := map[string]string{"actor": "Actor", "team": "Team", "action": "Action", "target": "Target", "outcome": "Outcome"}
+	for query, field := range fields {
+		if value := c.Query(query); value != "" {
+			filter[field] = value
+		}
+	}
+	timeRange := bson.M{}
+	for query, operator := range map[string]string{"from": "$gte", "to": "$lte"} {
+		value := c.Query(query)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a time in RFC3339 format", query)
+		}
+		timeRange[operator] = parsed
+	}
+	if len(timeRange) > 0 {
+		filter["Time"] = timeRange
+	}
+	return filter, nil
+}
+
+func GetAuditLog(c *gin.Context) {
+	isSystemAuthorized := c.Params.ByName("isAuthorized")
+	if isSystemAuthorized == "false" {
+		RespondError(c, ErrForbidden, "Not authorized")
+		return
+	}
+	page, limit, err := GetPagination(c)
+	if err != nil {
+		RespondError(c, Invalid(err), fmt.Sprint(err))
+		return
+	}
+	filter, err := GetAuditFilter(c)
+	if err != nil {
+		RespondError(c, Invalid(err), fmt.Sprint(err))
+		return
+	}
+	findOptions := FindOptions{
+		Skip:  (page - 1) * limit,
+		Limit: limit,
+		Sort:  bson.D{{Key: "Time", Value: -1}},
+	}
+	entries, total, err := AuditFM.WithContext(RequestContext(c)).GetPage(filter, findOptions)
+	if err != nil {
+		RespondError(c, fmt.Errorf("GetAuditEntries: %w", err), "")
+		return
+	}
+	result, err := ConverttoAuditEntries(entries)
+	if err != nil {
+		RespondError(c, err, "")
+		return
+	}
+	c.IndentedJSON(200, auditlist{Entries: result, Total: total, Page: page, Limit: limit})
+}
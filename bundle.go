@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"gopkg.in/yaml.v2"
+)
+
+type ConfigBundle struct {
+	Team    string       `json:"Team" yaml:"Team"`
+	Configs []TeamConfig `json:"Configs" yaml:"Configs"`
+}
+
+type PlanItem struct {
+	Name    string                 `json:"Name" yaml:"Name"`
+	Action  string                 `json:"Action" yaml:"Action"`
+	Changes map[string]FieldChange `json:"Changes,omitempty" yaml:"Changes,omitempty"`
+}
+
+type importresult struct {
+	DryRun bool
+	Plan   []PlanItem
+}
+
+func ValidateTeamConfig(config TeamConfig) error {
+	if config.Name == "" || config.LogSeverity == "" || config.LogLogic == "" || config.NotificationMethod == "" || len(config.NotificationRecipient) == 0 {
+		return fmt.Errorf("logseverity, loglogic, name, notificationmethod, notificationrecipient fields cannot be null or empty")
+	}
+	return nil
+}
+
+func ValidateConfigBundle(bundle ConfigBundle, team string) error {
+	if bundle.Team != "" && bundle.Team != team {
+		return fmt.Errorf("bundle belongs to team %s, not to %s", bundle.Team, team)
+	}
+	names := map[string]bool{}
+	for i, config := range bundle.Configs {
+		if err := ValidateTeamConfig(config); err != nil {
+			return fmt.Errorf("configuration #%d: %s", i+1, err)
+		}
+		if names[config.Name] {
+			return fmt.Errorf("configuration name %s is given more than once", config.Name)
+		}
+		names[config.Name] = true
+	}
+	return nil
+}
+
+// TeamConfigDocument converts a configuration to the document stored in the config collection
+func TeamConfigDocument(config TeamConfig, team string) (bson.M, error) {
+	bytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	document := bson.M{}
+	err = json.Unmarshal(bytes, &document)
+	if err != nil {
+		return nil, err
+	}
+	document["Team"] = team
+	delete(document, "Revision")
+	delete(document, "ID")
+	return document, nil
+}
+
+// PlanConfigChanges compares desired configurations with stored ones and returns the needed actions ordered by name
+func PlanConfigChanges(desired []TeamConfig, stored []TeamConfig, team string, prune bool) ([]PlanItem, error) {
+	plan := []PlanItem{}
+	storedByName := map[string]TeamConfig{}
+	for _, config := range stored {
+		storedByName[config.Name] = config
+	}
+	desiredNames := map[string]bool{}
+	for _, config := range desired {
+		desiredNames[config.Name] = true
+		after, err := TeamConfigDocument(config, team)
+		if err != nil {
+			return nil, err
+		}
+		current, ok := storedByName[config.Name]
+		if !ok {
+			plan = append(plan, PlanItem{Name: config.Name, Action: "Create", Changes: DocumentDiff(nil, after)})
+			continue
+		}
+		before, err := TeamConfigDocument(current, team)
+		if err != nil {
+			return nil, err
+		}
+		changes := DocumentDiff(before, after)
+		action := "Update"
+		if len(changes) == 0 {
+			action = "NoOp"
+		}
+		plan = append(plan, PlanItem{Name: config.Name, Action: action, Changes: changes})
+	}
+	if prune {
+		for _, config := range stored {
+			if desiredNames[config.Name] {
+				continue
+			}
+			before, err := TeamConfigDocument(config, team)
+			if err != nil {
+				return nil, err
+			}
+			plan = append(plan, PlanItem{Name: config.Name, Action: "Delete", Changes: DocumentDiff(before, nil)})
+		}
+	}
+	sort.Slice(plan, func(i, j int) bool { return plan[i].Name < plan[j].Name })
+	return plan, nil
+}
+
+// ApplyConfigPlan stores every planned change, records its revision and publishes one change event per affected configuration.
+// Updates and deletes only match the stored revisions the plan was made from
+func ApplyConfigPlan(c *gin.Context, team string, plan []PlanItem, desired []TeamConfig, stored []TeamConfig) error {
+	desiredByName := map[string]TeamConfig{}
+	for _, config := range desired {
+		desiredByName[config.Name] = config
+	}
+	storedByName := map[string]TeamConfig{}
+	for _, config := range stored {
+		storedByName[config.Name] = config
+	}
+	for _, item := range plan {
+		filter := bson.M{"Team": team, "Name": item.Name}
+		switch item.Action {
+		case "Create":
+			document, err := TeamConfigDocument(desiredByName[item.Name], team)
+			if err != nil {
+				return err
+			}
+			document["Revision"] = 1
+			document["ID"] = NewConfigID()
+			if err := ConfigFM.WithContext(RequestContext(c)).Insert(document); err != nil {
+				return fmt.Errorf("cannot create configuration %s: %w", item.Name, err)
+			}
+			RecordConfigRevisionOrLog(c, document, "Add")
+			if err := PublishConfigChange(c, document, "Add"); err != nil {
+				return err
+			}
+		case "Update":
+			document, err := TeamConfigDocument(desiredByName[item.Name], team)
+			if err != nil {
+				return err
+			}
+			filter["Revision"] = RevisionFilter(storedByName[item.Name].Revision)
+			update := bson.D{
+				{Key: "$set", Value: document},
+				{Key: "$inc", Value: bson.M{"Revision": 1}},
+			}
+			updatedConfig, err := ConfigFM.WithContext(RequestContext(c)).UpdateAndGet(filter, update)
+			if errors.Is(err, ErrNotFound) {
+				return fmt.Errorf("cannot update configuration %s, it was changed during the import: %w", item.Name, ErrConflict)
+			}
+			if err != nil {
+				return fmt.Errorf("cannot update configuration %s: %w", item.Name, err)
+			}
+			RecordConfigRevisionOrLog(c, updatedConfig, "Update")
+			if err := PublishConfigChange(c, updatedConfig, "Update"); err != nil {
+				return err
+			}
+		case "Delete":
+			filter["Revision"] = RevisionFilter(storedByName[item.Name].Revision)
+			storedConfig, err := ConfigFM.WithContext(RequestContext(c)).GetOne(filter)
+			if err == nil {
+				err = ConfigFM.WithContext(RequestContext(c)).Delete(filter)
+			}
+			if errors.Is(err, ErrNotFound) {
+				return fmt.Errorf("cannot delete configuration %s, it was changed during the import: %w", item.Name, ErrConflict)
+			}
+			if err != nil {
+				return fmt.Errorf("cannot delete configuration %s: %w", item.Name, err)
+			}
+			RecordConfigRevisionOrLog(c, storedConfig, "Delete")
+			if err := PublishConfigChange(c, storedConfig, "Delete"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func PlanSummary(plan []PlanItem) bson.M {
+	summary := bson.M{}
+	for _, item := range plan {
+		count, _ := summary[item.Action].(int)
+		summary[item.Action] = count + 1
+	}
+	return summary
+}
+
+func isYAMLRequest(c *gin.Context, header string) bool {
+	if format := c.Query("format"); format != "" {
+		return strings.EqualFold(format, "yaml") || strings.EqualFold(format, "yml")
+	}
+	return strings.Contains(c.GetHeader(header), "yaml")
+}
+
+func GetTeamConfigs(ctx context.Context, team string) ([]TeamConfig, error) {
+	configs, err := ConfigFM.WithContext(ctx).Get(bson.M{"Team": team})
+	if err != nil {
+		return nil, err
+	}
+	teamconfigs, err := ConverttoTeamConfigs(configs)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(teamconfigs, func(i, j int) bool { return teamconfigs[i].Name < teamconfigs[j].Name })
+	return teamconfigs, nil
+}
+
+func BindConfigBundle(c *gin.Context) (ConfigBundle, error) {
+	bundle := ConfigBundle{}
+	bytes, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return bundle, err
+	}
+	if isYAMLRequest(c, "Content-Type") {
+		err = yaml.UnmarshalStrict(bytes, &bundle)
+	} else {
+		decoder := json.NewDecoder(strings.NewReader(string(bytes)))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&bundle)
+	}
+	if err != nil {
+		return bundle, fmt.Errorf("body must be a configuration bundle in json or yaml format")
+	}
+	return bundle, nil
+}
+
+func ExportmyConfigs(c *gin.Context) {
+	team := c.Params.ByName("Team")
+	teamconfigs, err := GetTeamConfigs(RequestContext(c), team)
+	if err != nil {
+		RespondError(c, fmt.Errorf("GetTeamConfigs: %w", err), "")
+		return
+	}
+	bundle := ConfigBundle{Team: team, Configs: teamconfigs}
+	if isYAMLRequest(c, "Accept") {
+		c.YAML(200, bundle)
+		return
+	}
+	c.IndentedJSON(200, bundle)
+}
+
+func ImportmyConfigs(c *gin.Context) {
+	team := c.Params.ByName("Team")
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dryRun", "false"))
+	if err != nil {
+		RespondError(c, ErrInvalid, "dryRun must be true or false")
+		return
+	}
+	prune, err := strconv.ParseBool(c.DefaultQuery("prune", "false"))
+	if err != nil {
+		RespondError(c, ErrInvalid, "prune must be true or false")
+		return
+	}
+	bundle, err := BindConfigBundle(c)
+	if err != nil {
+		RespondError(c, Invalid(err), fmt.Sprint(err))
+		return
+	}
+	err = ValidateConfigBundle(bundle, team)
+	if err != nil {
+		RespondError(c, Invalid(err), fmt.Sprint(err))
+		return
+	}
+	exists, err := TeamExists(RequestContext(c), team)
+	if err == nil && !exists {
+		RespondError(c, ErrNotFound, fmt.Sprintf("no team found with name: %s", team))
+		return
+	}
+	stored := []TeamConfig{}
+	if err == nil {
+		stored, err = GetTeamConfigs(RequestContext(c), team)
+	}
+	if err != nil {
+		RespondError(c, fmt.Errorf("GetTeamConfigs: %w", err), "")
+		return
+	}
+	plan, err := PlanConfigChanges(bundle.Configs, stored, team, prune)
+	if err != nil {
+		RespondError(c, err, "")
+		return
+	}
+	if dryRun {
+		c.IndentedJSON(200, importresult{DryRun: true, Plan: plan})
+		return
+	}
+	err = ApplyConfigPlan(c, team, plan, bundle.Configs, stored)
+	SetAuditChange(c, team, nil, PlanSummary(plan))
+	if err != nil {
+		RespondOutcome(c, fmt.Errorf("ApplyConfigPlan: %w", err), "Import was not fully applied. Please export the configurations and retry")
+		return
+	}
+	c.IndentedJSON(200, importresult{DryRun: false, Plan: plan})
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+	"gopkg.in/yaml.v2"
+)
+
+// Exit codes of the command line client, API errors are mapped by their http status
+const (
+	exitOK            = 0
+	exitError         = 1 // Local errors like unreadable files
+	exitUsage         = 2 // Wrong command line arguments
+	exitNotAuthorized = 3 // 401, 403
+	exitNotFound      = 4 // 404
+	exitConflict      = 5 // 409, 412, 428
+	exitInvalid       = 6 // 400, 422, 424 and other client errors
+	exitUnavailable   = 7 // 5xx and connection failures
+)
+
+type clientprofile struct {
+	URL      string `yaml:"url"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+type apiclient struct {
+	profile clientprofile
+	http    *http.Client
+	output  string
+	stdin   io.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+}
+
+type apierror struct {
+	Status  int
+	Message string
+}
+
+func (e apierror) Error() string {
+	return e.Message
+}
+
+func ExitCode(status int) int {
+	switch {
+	case status >= 200 && status < 300:
+		return exitOK
+	case status == 401 || status == 403:
+		return exitNotAuthorized
+	case status == 404:
+		return exitNotFound
+	case status == 409 || status == 412 || status == 428:
+		return exitConflict
+	case status >= 400 && status < 500:
+		return exitInvalid
+	}
+	return exitUnavailable
+}
+
+func defaultProfilesPath() string {
+	if path := os.Getenv("LOG2N_PROFILES"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".log2n.yaml"
+	}
+	return filepath.Join(home, ".log2n", "profiles.yaml")
+}
+
+// LoadClientProfile reads a named profile from the profiles file, environment variables override its values
+func LoadClientProfile(path string, name string) (clientprofile, error) {
+	profile := clientprofile{}
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return profile, err
+	}
+	if err == nil {
+		profiles := map[string]clientprofile{}
+		if err := yaml.UnmarshalStrict(content, &profiles); err != nil {
+			return profile, fmt.Errorf("cannot parse profiles file %s: %s", path, err)
+		}
+		stored, ok := profiles[name]
+		if !ok && name != "default" {
+			return profile, fmt.Errorf("cannot find profile %s in %s", name, path)
+		}
+		profile = stored
+	}
+	profile.URL = getOptionalEnv("LOG2N_URL", profile.URL)
+	profile.User = getOptionalEnv("LOG2N_USER", profile.User)
+	profile.Password = getOptionalEnv("LOG2N_PASSWORD", profile.Password)
+	if profile.URL == "" {
+		profile.URL = "http://localhost:8080"
+	}
+	profile.URL = strings.TrimSuffix(profile.URL, "/")
+	return profile, nil
+}
+
+func (a apiclient) Do(method string, path string, body []byte, headers map[string]string) ([]byte, http.Header, error) {
+	request, err := http.NewRequest(method, a.profile.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	request.SetBasicAuth(a.profile.User, a.profile.Password)
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	response, err := a.http.Do(request)
+	if err != nil {
+		return nil, nil, apierror{Status: 503, Message: fmt.Sprint(err)}
+	}
+	defer response.Body.Close()
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, apierror{Status: 503, Message: fmt.Sprint(err)}
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		result := httpresponse{}
+		message := strings.TrimSpace(string(content))
+		if json.Unmarshal(content, &result) == nil && result.Message != "" {
+			message = strings.TrimSpace(result.Message)
+			if result.RequestID != "" {
+				message = fmt.Sprintf("%s (request ID: %s)", message, result.RequestID)
+			}
+		}
+		return nil, nil, apierror{Status: response.StatusCode, Message: message}
+	}
+	return content, response.Header, nil
+}
+
+// Print writes an API response in the selected output format, table columns are used only for table output
+func (a apiclient) Print(content []byte, columns []string) error {
+	var document interface{}
+	if err := json.Unmarshal(content, &document); err != nil {
+		return err
+	}
+	switch a.output {
+	case "json":
+		formatted, err := json.MarshalIndent(document, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(a.stdout, string(formatted))
+	case "yaml":
+		formatted, err := yaml.Marshal(document)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(a.stdout, string(formatted))
+	default:
+		rows, ok := document.([]interface{})
+		if !ok {
+			rows = []interface{}{document}
+		}
+		writer := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, strings.ToUpper(strings.Join(columns, "\t")))
+		for _, row := range rows {
+			values := []string{}
+			fields, _ := row.(map[string]interface{})
+			for _, column := range columns {
+				values = append(values, formatCell(fields[column]))
+			}
+			fmt.Fprintln(writer, strings.Join(values, "\t"))
+		}
+		writer.Flush()
+	}
+	return nil
+}
+
+func formatCell(value interface{}) string {
+	switch typed := value.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		items := []string{}
+		for _, item := range typed {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// readDocument reads a json or yaml file, "-" means standard input, and returns it as json
+func (a apiclient) readDocument(path string) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file must be given with -f")
+	}
+	var content []byte
+	var err error
+	if path == "-" {
+		content, err = io.ReadAll(a.stdin)
+	} else {
+		content, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var document interface{}
+	if json.Unmarshal(content, &document) == nil {
+		return content, nil
+	}
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, fmt.Errorf("%s must be in json or yaml format", path)
+	}
+	return json.Marshal(yamlToJSON(document))
+}
+
+// yamlToJSON converts maps decoded by yaml to the ones json can marshal
+func yamlToJSON(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[interface{}]interface{}:
+		result := map[string]interface{}{}
+		for key, item := range typed {
+			result[fmt.Sprint(key)] = yamlToJSON(item)
+		}
+		return result
+	case []interface{}:
+		for i, item := range typed {
+			typed[i] = yamlToJSON(item)
+		}
+	}
+	return value
+}
+
+func (a apiclient) readPassword(prompt string) (string, error) {
+	return readPassword(a.stdin, a.stderr, prompt)
+}
+
+func (a apiclient) readLine(prompt string) (string, error) {
+	return readLine(a.stdin, a.stderr, prompt)
+}
+
+// readPassword reads without echo from a terminal, piped input is read as a line
+func readPassword(stdin io.Reader, stderr io.Writer, prompt string) (string, error) {
+	if password := os.Getenv("LOG2N_NEW_PASSWORD"); password != "" {
+		return password, nil
+	}
+	file, ok := stdin.(*os.File)
+	if !ok || !term.IsTerminal(int(file.Fd())) {
+		return readLine(stdin, stderr, prompt)
+	}
+	fmt.Fprint(stderr, prompt)
+	password, err := term.ReadPassword(int(file.Fd()))
+	fmt.Fprintln(stderr)
+	if err != nil {
+		return "", fmt.Errorf("cannot read password: %s", err)
+	}
+	return string(password), nil
+}
+
+func readLine(stdin io.Reader, stderr io.Writer, prompt string) (string, error) {
+	fmt.Fprint(stderr, prompt)
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("cannot read from standard input")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (a apiclient) printMessage(content []byte, message string) {
+	if a.output == "table" {
+		fmt.Fprintln(a.stdout, message)
+		return
+	}
+	a.Print(content, nil)
+}
+
+var configColumns = []string{"ID", "Name", "Team", "LogSeverity", "LogLogic", "NotificationMethod", "NotificationRecipient", "Revision"}
+var planColumns = []string{"Name", "Action"}
+
+func (a apiclient) runConfig(args []string) error {
+	if len(args) == 0 {
+		return usageError("config list|get|create|update|delete|apply|diff")
+	}
+	flags := flag.NewFlagSet("config "+args[0], flag.ContinueOnError)
+	flags.SetOutput(a.stderr)
+	file := flags.String("f", "", "json or yaml file, - for standard input")
+	ifMatch := flags.String("if-match", "", "ETag the stored configuration must still have")
+	yes := flags.Bool("yes", false, "apply the plan without asking")
+	if err := flags.Parse(args[1:]); err != nil {
+		return usageError(err.Error())
+	}
+	switch args[0] {
+	case "list":
+		content, _, err := a.Do("GET", "/api/1/config", nil, nil)
+		if err != nil {
+			return err
+		}
+		return a.Print(content, configColumns)
+	case "get":
+		if flags.NArg() != 1 {
+			return usageError("config get NAME")
+		}
+		content, headers, err := a.Do("GET", "/api/1/config/"+url.PathEscape(flags.Arg(0)), nil, nil)
+		if err != nil {
+			return err
+		}
+		if a.output == "table" {
+			fmt.Fprintf(a.stderr, "ETag: %s\n", headers.Get("ETag"))
+		}
+		return a.Print(content, configColumns)
+	case "create", "update":
+		body, err := a.readDocument(*file)
+		if err != nil {
+			return err
+		}
+		method := map[string]string{"create": "POST", "update": "PUT"}[args[0]]
+		headers := map[string]string{}
+		if *ifMatch != "" {
+			headers["If-Match"] = *ifMatch
+		}
+		content, _, err := a.Do(method, "/api/1/config", body, headers)
+		if err != nil {
+			return err
+		}
+		a.printMessage(content, "configuration stored")
+		return nil
+	case "delete":
+		if flags.NArg() != 1 {
+			return usageError("config delete NAME")
+		}
+		body, _ := json.Marshal(map[string]string{"Name": flags.Arg(0)})
+		headers := map[string]string{}
+		if *ifMatch != "" {
+			headers["If-Match"] = *ifMatch
+		}
+		content, _, err := a.Do("DELETE", "/api/1/config", body, headers)
+		if err != nil {
+			return err
+		}
+		a.printMessage(content, "configuration removed")
+		return nil
+	case "apply", "diff":
+		if args[0] == "apply" && *file == "-" && !*yes {
+			return usageError("config apply -f - needs --yes, standard input cannot answer the confirmation once it holds the document")
+		}
+		body, err := a.readDocument(*file)
+		if err != nil {
+			return err
+		}
+		content, _, err := a.Do("POST", "/api/1/config/sync", body, nil)
+		if err != nil {
+			return err
+		}
+		result := syncresult{}
+		if err := json.Unmarshal(content, &result); err != nil {
+			return err
+		}
+		plan, _ := json.Marshal(result.Plan)
+		if err := a.Print(plan, planColumns); err != nil {
+			return err
+		}
+		if args[0] == "diff" {
+			return nil
+		}
+		if !*yes {
+			answer, _ := a.readLine("Apply this plan? [y/N]: ")
+			if !strings.EqualFold(answer, "y") && !strings.EqualFold(answer, "yes") {
+				fmt.Fprintln(a.stderr, "plan was not applied")
+				return nil
+			}
+		}
+		content, _, err = a.Do("POST", "/api/1/config/sync?planId="+url.QueryEscape(result.PlanID), body, nil)
+		if err != nil {
+			return err
+		}
+		a.printMessage(content, "plan applied")
+		return nil
+	}
+	return usageError("config list|get|create|update|delete|apply|diff")
+}
+
+func (a apiclient) runUser(args []string) error {
+	if len(args) == 0 {
+		return usageError("user add|passwd|remove")
+	}
+	flags := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	flags.SetOutput(a.stderr)
+	team := flags.String("team", "", "team of the new user")
+	mustChange := flags.Bool("must-change", false, "force the user to change the password at next login")
+	if err := flags.Parse(args[1:]); err != nil {
+		return usageError(err.Error())
+	}
+	switch args[0] {
+	case "add":
+		if flags.NArg() != 1 || *team == "" {
+			return usageError("user add -team TEAM [-must-change] NAME")
+		}
+		password, err := a.readPassword("Password: ")
+		if err != nil {
+			return err
+		}
+		body, _ := json.Marshal(map[string]interface{}{"Name": flags.Arg(0), "Team": *team, "Password": password, "MustChangePassword": *mustChange})
+		content, _, err := a.Do("POST", "/api/1/user", body, nil)
+		if err != nil {
+			return err
+		}
+		a.printMessage(content, "user added")
+		return nil
+	case "passwd":
+		if flags.NArg() > 1 {
+			return usageError("user passwd [NAME]")
+		}
+		password, err := a.readPassword("New password: ")
+		if err != nil {
+			return err
+		}
+		user := map[string]interface{}{"Name": flags.Arg(0), "Password": password}
+		if *mustChange {
+			user["MustChangePassword"] = true
+		}
+		body, _ := json.Marshal(user)
+		content, _, err := a.Do("PUT", "/api/1/user", body, nil)
+		if err != nil {
+			return err
+		}
+		a.printMessage(content, "password changed")
+		return nil
+	case "remove":
+		if flags.NArg() != 1 {
+			return usageError("user remove NAME")
+		}
+		body, _ := json.Marshal(map[string]string{"Name": flags.Arg(0)})
+		content, _, err := a.Do("DELETE", "/api/1/user", body, nil)
+		if err != nil {
+			return err
+		}
+		a.printMessage(content, "user removed")
+		return nil
+	}
+	return usageError("user add|passwd|remove")
+}
+
+type usageerror struct {
+	message string
+}
+
+func (e usageerror) Error() string {
+	return "usage: " + e.message
+}
+
+func usageError(message string) error {
+	return usageerror{message: message}
+}
+
+// RunClient runs the config and user commands of the command line client and returns the process exit code
+func RunClient(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("client", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	profileName := flags.String("profile", "default", "profile name in the profiles file")
+	profilesPath := flags.String("profiles", defaultProfilesPath(), "profiles file")
+	output := flags.String("o", "table", "output format: table, json or yaml")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *output != "table" && *output != "json" && *output != "yaml" {
+		fmt.Fprintln(stderr, "usage: -o must be table, json or yaml")
+		return exitUsage
+	}
+	profile, err := LoadClientProfile(*profilesPath, *profileName)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	client := apiclient{
+		profile: profile,
+		http:    &http.Client{Timeout: 30 * time.Second},
+		output:  *output,
+		stdin:   stdin,
+		stdout:  stdout,
+		stderr:  stderr,
+	}
+	rest := flags.Args()
+	if len(rest) == 0 {
+		fmt.Fprintln(stderr, "usage: [-profile NAME] [-o table|json|yaml] config|user COMMAND")
+		return exitUsage
+	}
+	switch rest[0] {
+	case "config":
+		err = client.runConfig(rest[1:])
+	case "user":
+		err = client.runUser(rest[1:])
+	default:
+		err = usageError("config|user COMMAND")
+	}
+	switch typed := err.(type) {
+	case nil:
+		return exitOK
+	case usageerror:
+		fmt.Fprintln(stderr, typed)
+		return exitUsage
+	case apierror:
+		fmt.Fprintln(stderr, typed)
+		return ExitCode(typed.Status)
+	}
+	fmt.Fprintln(stderr, err)
+	return exitError
+}
@@ -1,41 +1,97 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var GlobalConfig webconfig
-var CM Breaker
+var CM *Breaker
+var Secrets *SecretStore
 
 type httpresponse struct {
-	Status  bool
-	Message string
+	Status    bool
+	Message   string
+	ID        string `json:",omitempty"`
+	Code      string `json:",omitempty"`
+	RequestID string `json:",omitempty"`
 }
 
 type TeamConfig struct {
-	Name                  string   `bson:"Name" json:"Name"`
-	Team                  string   `bson:"Team" json:"Team"`
-	LogPattern            string   `bson:"LogPattern" json:"LogPattern"`
-	LogSeverity           string   `bson:"LogSeverity" json:"LogSeverity"`
-	NotificationMethod    string   `bson:"NotificationMethod" json:"NotificationMethod"`
-	LogLogic              string   `bson:"LogLogic" json:"LogLogic"`
-	NotificationRecipient []string `bson:"NotificationRecipient" json:"NotificationRecipient"`
-	HoldTime              int      `bson:"HoldTime" json:"HoldTime"`
-	RetryCount            int      `bson:"RetryCount" json:"RetryCount"`
+	ID                    string   `bson:"ID" json:"ID" yaml:"ID,omitempty"`
+	Name                  string   `bson:"Name" json:"Name" yaml:"Name"`
+	Team                  string   `bson:"Team" json:"Team" yaml:"Team"`
+	LogPattern            string   `bson:"LogPattern" json:"LogPattern" yaml:"LogPattern"`
+	LogSeverity           string   `bson:"LogSeverity" json:"LogSeverity" yaml:"LogSeverity"`
+	NotificationMethod    string   `bson:"NotificationMethod" json:"NotificationMethod" yaml:"NotificationMethod"`
+	LogLogic              string   `bson:"LogLogic" json:"LogLogic" yaml:"LogLogic"`
+	NotificationRecipient []string `bson:"NotificationRecipient" json:"NotificationRecipient" yaml:"NotificationRecipient"`
+	HoldTime              int      `bson:"HoldTime" json:"HoldTime" yaml:"HoldTime"`
+	RetryCount            int      `bson:"RetryCount" json:"RetryCount" yaml:"RetryCount"`
+	Revision              int      `bson:"Revision" json:"Revision" yaml:"Revision"`
+}
+
+type Team struct {
+	Name    string    `bson:"Name" json:"Name"`
+	Created time.Time `bson:"Created" json:"Created"`
+}
+
+type ApiUser struct {
+	Team               string    `bson:"Team" json:"Team"`
+	Name               string    `bson:"Name" json:"Name"`
+	PasswordCreated    time.Time `bson:"PasswordCreated" json:"PasswordCreated"`
+	MustChangePassword bool      `bson:"MustChangePassword" json:"MustChangePassword"`
+}
+
+type userlist struct {
+	Users []ApiUser
+	Total int64
+	Page  int64
+	Limit int64
 }
 
 type qconfig struct {
 	QConnectionString string
 	QName             string
+	QServerAddress    string
+	QSecret           string // name of the secret holding user:password of the broker
+}
+
+// QURI returns the broker URL with the current credentials, a connection is dialed per message
+func (q qconfig) QURI() string {
+	if userpass, ok := Secrets.Value(q.QSecret); ok && q.QSecret != "" {
+		return fmt.Sprintf("amqp://%s@%s", userpass, q.QServerAddress)
+	}
+	return q.QConnectionString
 }
 
 type webconfig struct {
-	DBConf []DBConfig
+	DBConf          []DBConfig
+	TeamDBConf      DBConfig
+	AuditDBConf     DBConfig
+	RevisionDBConf  DBConfig
+	MigrationDBConf DBConfig
+	RunMigrations   bool
+	PasswordPolicy  PasswordPolicy
+	RequireIfMatch  bool
+	LogLevel        slog.Level
+	TracesExporter  string
+	DrainTimeout    time.Duration
+	PreStopDelay    time.Duration
+	TLS             tlsconfig
+	SecretsRefresh  time.Duration
 	qconfig
 }
 
@@ -48,6 +104,30 @@ func GetHash(s string) string {
 	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
 }
 
+func getOptionalEnv(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getCommonConfig(conf DBConfig) commonconfig {
+	return commonconfig{
+		DBConfig{
+			Database:         conf.Database,
+			Collection:       conf.Collection,
+			Connectionstring: conf.Connectionstring,
+			ConnectionSecret: conf.ConnectionSecret,
+		},
+		qconfig{
+			QConnectionString: GlobalConfig.QConnectionString,
+			QServerAddress:    GlobalConfig.QServerAddress,
+			QSecret:           GlobalConfig.QSecret,
+			QName:             GlobalConfig.QName,
+		},
+	}
+}
+
 func throw(err error) {
 	if err != nil {
 		panic(err)
@@ -91,75 +171,226 @@ func getEnvs() error {
 	if QServerAddress == "" {
 		return fmt.Errorf("cannot get environment variable qserveraddress")
 	}
-	configdbcsbytes, err := os.ReadFile(ConfigDBCS)
+	var err error
+	Secrets, err = newSecretStoreFromEnv()
 	if err != nil {
 		return err
 	}
-	userdbcsbytes, err := os.ReadFile(userDBCS)
+	configConnectionString, err := Secrets.Add("configDBCS", ConfigDBCS)
 	if err != nil {
 		return err
 	}
-	configConnectionString := strings.Split(string(configdbcsbytes), "\n")[0]
-	userConnectionString := strings.Split(string(userdbcsbytes), "\n")[0]
-	db1 := DBConfig{Database: configDB, Collection: configCol, Connectionstring: configConnectionString}
-	db2 := DBConfig{Database: userDB, Collection: userCol, Connectionstring: userConnectionString}
+	userConnectionString, err := Secrets.Add("userDBCS", userDBCS)
+	if err != nil {
+		return err
+	}
+	db1 := DBConfig{Database: configDB, Collection: configCol, Connectionstring: configConnectionString, ConnectionSecret: "configDBCS"}
+	db2 := DBConfig{Database: userDB, Collection: userCol, Connectionstring: userConnectionString, ConnectionSecret: "userDBCS"}
 	dbconf := []DBConfig{db1, db2}
-	qcsbytes, err := os.ReadFile(QCS)
+	QUserPass, err := Secrets.Add("QCS", QCS)
 	if err != nil {
 		return err
 	}
-	QUserPass := strings.Split(string(qcsbytes), "\n")[0]
 	QConnectionString := fmt.Sprintf("amqp://%s@%s", QUserPass, QServerAddress)
+	policy, err := getPasswordPolicyEnvs()
+	if err != nil {
+		return err
+	}
 	GlobalConfig.DBConf = dbconf
+	GlobalConfig.TeamDBConf = DBConfig{Database: configDB, Collection: getOptionalEnv("teamCol", "teams"), Connectionstring: configConnectionString, ConnectionSecret: "configDBCS"}
+	GlobalConfig.AuditDBConf = DBConfig{Database: configDB, Collection: getOptionalEnv("auditCol", "audit"), Connectionstring: configConnectionString, ConnectionSecret: "configDBCS"}
+	GlobalConfig.RevisionDBConf = DBConfig{Database: configDB, Collection: getOptionalEnv("revisionCol", "revisions"), Connectionstring: configConnectionString, ConnectionSecret: "configDBCS"}
+	GlobalConfig.MigrationDBConf = DBConfig{Database: configDB, Collection: getOptionalEnv("migrationCol", "migrations"), Connectionstring: configConnectionString, ConnectionSecret: "configDBCS"}
+	GlobalConfig.RunMigrations, err = strconv.ParseBool(getOptionalEnv("runMigrations", "true"))
+	if err != nil {
+		return fmt.Errorf("environment variable runmigrations must be true or false")
+	}
+	GlobalConfig.PasswordPolicy = policy
+	GlobalConfig.RequireIfMatch, err = strconv.ParseBool(getOptionalEnv("requireIfMatch", "false"))
+	if err != nil {
+		return fmt.Errorf("environment variable requireifmatch must be true or false")
+	}
+	GlobalConfig.LogLevel, err = ParseLogLevel(getOptionalEnv("logLevel", "info"))
+	if err != nil {
+		return fmt.Errorf("environment variable loglevel: %s", err)
+	}
+	GlobalConfig.TracesExporter = getOptionalEnv("tracesExporter", "none")
+	if GlobalConfig.TracesExporter != "none" && GlobalConfig.TracesExporter != "stdout" && GlobalConfig.TracesExporter != "otlp" {
+		return fmt.Errorf("environment variable tracesexporter must be none, stdout or otlp")
+	}
+	GlobalConfig.DrainTimeout, err = time.ParseDuration(getOptionalEnv("drainTimeout", "30s"))
+	if err != nil || GlobalConfig.DrainTimeout <= 0 {
+		return fmt.Errorf("environment variable draintimeout must be a positive duration such as 30s")
+	}
+	GlobalConfig.PreStopDelay, err = time.ParseDuration(getOptionalEnv("preStopDelay", "0s"))
+	if err != nil || GlobalConfig.PreStopDelay < 0 {
+		return fmt.Errorf("environment variable prestopdelay must be a duration such as 5s")
+	}
+	GlobalConfig.SecretsRefresh, err = time.ParseDuration(getOptionalEnv("secretsRefreshInterval", "30s"))
+	if err != nil || GlobalConfig.SecretsRefresh <= 0 {
+		return fmt.Errorf("environment variable secretsrefreshinterval must be a positive duration such as 30s")
+	}
+	GlobalConfig.TLS, err = getTLSEnvs()
+	if err != nil {
+		return err
+	}
 	GlobalConfig.QConnectionString = QConnectionString
+	GlobalConfig.QServerAddress = QServerAddress
+	GlobalConfig.QSecret = "QCS"
 	GlobalConfig.QName = QName
 	return nil
 }
 
+// newSecretStoreFromEnv reads files and environment variables, and a Vault compatible server when vaultAddr is set
+func newSecretStoreFromEnv() (*SecretStore, error) {
+	sources := map[string]secretsource{"file": FileSecret, "env": EnvSecret}
+	if address := os.Getenv("vaultAddr"); address != "" {
+		token := os.Getenv("vaultToken")
+		if tokenFile := os.Getenv("vaultTokenFile"); tokenFile != "" {
+			var err error
+			token, err = FileSecret(tokenFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if token == "" {
+			return nil, fmt.Errorf("environment variable vaultaddr requires vaulttoken or vaulttokenfile")
+		}
+		sources["vault"] = VaultSecret(address, token, &http.Client{Timeout: 5 * time.Second})
+	}
+	return NewSecretStore(sources), nil
+}
+
+func getTLSEnvs() (tlsconfig, error) {
+	conf := tlsconfig{
+		CertFile:     os.Getenv("tlsCertFile"),
+		KeyFile:      os.Getenv("tlsKeyFile"),
+		ClientCAFile: os.Getenv("tlsClientCAFile"),
+	}
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return conf, fmt.Errorf("environment variables tlscertfile and tlskeyfile must be given together")
+	}
+	if conf.ClientCAFile != "" && !conf.Enabled() {
+		return conf, fmt.Errorf("environment variable tlsclientcafile requires tlscertfile and tlskeyfile")
+	}
+	var err error
+	conf.MinVersion, err = ParseTLSVersion(getOptionalEnv("tlsMinVersion", "1.2"))
+	if err != nil {
+		return conf, fmt.Errorf("environment variable tlsminversion: %s", err)
+	}
+	conf.RequireClientCert, err = strconv.ParseBool(getOptionalEnv("tlsRequireClientCert", "false"))
+	if err != nil || (conf.RequireClientCert && conf.ClientCAFile == "") {
+		return conf, fmt.Errorf("environment variable tlsrequireclientcert must be true or false and requires tlsclientcafile")
+	}
+	return conf, nil
+}
+
+func initFileManagers() {
+	ConfigFM = namedFileManager("config", GlobalConfig.DBConf[0])
+	UserFM = namedFileManager("user", GlobalConfig.DBConf[1])
+	TeamFM = namedFileManager("team", GlobalConfig.TeamDBConf)
+	AuditFM = namedFileManager("audit", GlobalConfig.AuditDBConf)
+	RevisionFM = namedFileManager("revision", GlobalConfig.RevisionDBConf)
+	MigrationFM = namedFileManager("migration", GlobalConfig.MigrationDBConf)
+}
+
+func namedFileManager(name string, conf DBConfig) FileManager {
+	fm := GetFileManagerDefaultInstace(getCommonConfig(conf))
+	fm.Name = name
+	return fm
+}
+
+// NewRouter registers the middleware and every route, apiOperations must describe the same routes
+func NewRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.Use(RequestID, Tracing, AccessLog, Metrics)
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	router.GET("/healthz", Healthz)
+	router.GET("/readyz", Readyz)
+	router.GET("/api/openapi.json", GetOpenAPI)
+	router.GET("/api/1/config", Authenticate, GetmyConfig)
+	router.POST("/api/1/config", Audit("AddConfig"), Authenticate, AddmyConfig)
+	router.PUT("/api/1/config", Audit("SetConfig"), Authenticate, SetmyConfig)
+	router.DELETE("/api/1/config", Audit("RemoveConfig"), Authenticate, RemovemyConfig)
+	router.GET("/api/1/config/export", Authenticate, ExportmyConfigs)
+	router.POST("/api/1/config/import", Audit("ImportConfigs"), Authenticate, ImportmyConfigs)
+	router.POST("/api/1/config/sync", Audit("SyncConfigs"), Authenticate, SyncmyConfigs)
+	router.GET("/api/1/config/id/:id", Authenticate, GetmyConfigByID)
+	router.GET("/api/1/config/:name", Authenticate, GetmyConfigByName)
+	router.GET("/api/1/config/:name/revisions", Authenticate, GetConfigRevisions)
+	router.GET("/api/1/config/:name/revisions/:revision", Authenticate, GetConfigRevision)
+	router.GET("/api/1/config/:name/diff", Authenticate, GetConfigDiff)
+	router.POST("/api/1/config/:name/rollback", Audit("RollbackConfig"), Authenticate, RollbackmyConfig)
+	router.GET("/api/1/team", Authenticate, SystemAuthorize, GetTeams)
+	router.POST("/api/1/team", Audit("AddTeam"), Authenticate, SystemAuthorize, AddTeam)
+	router.PUT("/api/1/team", Audit("SetTeam"), Authenticate, SystemAuthorize, SetTeam)
+	router.DELETE("/api/1/team", Audit("RemoveTeam"), Authenticate, SystemAuthorize, RemoveTeam)
+	router.GET("/api/1/audit", Authenticate, SystemAuthorize, GetAuditLog)
+	router.GET("/api/1/user", Authenticate, SystemAuthorize, GetApiUsers)
+	router.GET("/api/1/user/:name", Authenticate, SystemAuthorize, GetApiUser)
+	router.POST("/api/1/user", Audit("AddUser"), Authenticate, SystemAuthorize, AddApiUser)
+	router.PUT("/api/1/user", Audit("SetUser"), Authenticate, SystemAuthorize, SetApiUser)
+	router.DELETE("/api/1/user", Audit("RemoveUser"), Authenticate, SystemAuthorize, RemoveApiUser)
+	v2 := router.Group("/api/2")
+	v2.GET("/teams/:team/configs", Authenticate, SystemAuthorize, TeamAccess, ListConfigsV2)
+	v2.POST("/teams/:team/configs", Audit("AddConfig"), Authenticate, SystemAuthorize, TeamAccess, AddConfigV2)
+	v2.GET("/teams/:team/configs/:name", Authenticate, SystemAuthorize, TeamAccess, GetmyConfigByName)
+	v2.PUT("/teams/:team/configs/:name", Audit("SetConfig"), Authenticate, SystemAuthorize, TeamAccess, SetConfigV2)
+	v2.DELETE("/teams/:team/configs/:name", Audit("RemoveConfig"), Authenticate, SystemAuthorize, TeamAccess, RemoveConfigV2)
+	v2.GET("/users", Authenticate, SystemAuthorize, ListUsersV2)
+	v2.POST("/users", Audit("AddUser"), Authenticate, SystemAuthorize, AddUserV2)
+	v2.GET("/users/:name", Authenticate, SystemAuthorize, GetApiUser)
+	v2.PUT("/users/:name", Audit("SetUser"), Authenticate, SystemAuthorize, SetUserV2)
+	v2.DELETE("/users/:name", Audit("RemoveUser"), Authenticate, SystemAuthorize, RemoveUserV2)
+	return router
+}
+
 func main() {
+	// Any argument turns the binary into an admin tool or the command line client of a running service
+	if len(os.Args) > 1 {
+		os.Exit(RunCommand(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
 	err := getEnvs()
 	throw(err)
+	Logger = NewLogger(os.Stderr, GlobalConfig.LogLevel)
+	slog.SetDefault(Logger)
+	shutdownTracing, err := SetupTracing(GlobalConfig.TracesExporter, os.Stdout)
+	throw(err)
 	for _, dbconf := range GlobalConfig.DBConf {
 		err := ValidateDBConfig(dbconf)
 		throw(err)
 	}
-	common1 := commonconfig{
-		DBConfig{
-			Database:         GlobalConfig.DBConf[0].Database,
-			Collection:       GlobalConfig.DBConf[0].Collection,
-			Connectionstring: GlobalConfig.DBConf[0].Connectionstring,
-		},
-		qconfig{
-			QConnectionString: GlobalConfig.QConnectionString,
-			QName:             GlobalConfig.QName,
-		},
-	}
-	common2 := commonconfig{
-		DBConfig{
-			Database:         GlobalConfig.DBConf[1].Database,
-			Collection:       GlobalConfig.DBConf[1].Collection,
-			Connectionstring: GlobalConfig.DBConf[1].Connectionstring,
-		},
-		qconfig{
-			QConnectionString: GlobalConfig.QConnectionString,
-			QName:             GlobalConfig.QName,
-		},
+	initFileManagers()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	go Secrets.Watch(ctx, GlobalConfig.SecretsRefresh)
+	if GlobalConfig.RunMigrations {
+		err = RunMigrations(os.Stdout)
+		throw(err)
 	}
-	ConfigFM = GetFileManagerDefaultInstace(common1)
-	UserFM = GetFileManagerDefaultInstace(common2)
 	CM = GetBreakerOverloadInstance(ConfigFM.SendMessage)
 	gin.SetMode(gin.ReleaseMode)
-	router := gin.Default()
-	router.GET("/api/1/config", Authenticate, GetmyConfig)
-	router.POST("/api/1/config", Authenticate, AddmyConfig)
-	router.PUT("/api/1/config", Authenticate, SetmyConfig)
-	router.DELETE("/api/1/config", Authenticate, RemovemyConfig)
-	router.POST("/api/1/user", Authenticate, SystemAuthorize, AddApiUser)
-	router.PUT("/api/1/user", Authenticate, SystemAuthorize, SetApiUser)
-	router.DELETE("/api/1/user", Authenticate, SystemAuthorize, RemoveApiUser)
+	router := NewRouter()
 	port := os.Getenv("HTTP_PORT")
 	if port == "" {
 		throw(fmt.Errorf("cannot find http_port environment variable"))
 	}
-	router.Run(":" + port)
+	server := &http.Server{Addr: ":" + port, Handler: router}
+	if GlobalConfig.TLS.Enabled() {
+		server.TLSConfig, err = NewTLSConfig(GlobalConfig.TLS)
+		throw(err)
+	}
+	listener, err := net.Listen("tcp", server.Addr)
+	throw(err)
+	serveErr := Serve(ctx, server, listener, GlobalConfig.PreStopDelay, GlobalConfig.DrainTimeout)
+	if serveErr != nil {
+		Logger.Error("http server stopped", "error", serveErr)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), GlobalConfig.DrainTimeout)
+	Shutdown(shutdownCtx, shutdownTracing)
+	cancel()
+	if serveErr != nil {
+		os.Exit(exitError)
+	}
 }
@@ -1,10 +1,41 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 func TestGetHash(t *testing.T) {
@@ -115,3 +146,1478 @@ func TestUpdateAndGetDocument(t *testing.T) {
 		t.Errorf("Didn't get expected values; LastName: %s, ok: %v", val, ok)
 	}
 }
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := GetPasswordPolicyDefaultInstance()
+	policy.MaxLength = 12
+	policy.RequireSymbol = true
+	policy.Blocklist = map[string]bool{"password1!a": true}
+	if failed := policy.Check("Str0ng!Pass", "admin"); len(failed) != 0 {
+		t.Errorf("Have to return no failed rules instead of %v", failed)
+	}
+	if failed := policy.Check("Admin!2024", "admin"); len(failed) != 1 {
+		t.Errorf("Have to return a single failed rule for a password containing user name instead of %v", failed)
+	}
+	if failed := policy.Check("Password1!A", ""); len(failed) != 1 {
+		t.Errorf("Have to return a single failed rule for a blocklisted password instead of %v", failed)
+	}
+	if failed := policy.Check("aaaaaaaaaaaaaa", ""); len(failed) != 4 {
+		t.Errorf("Have to return 4 failed rules instead of %v", failed)
+	}
+}
+
+func TestPasswordPolicyExpiryAndHistory(t *testing.T) {
+	policy := GetPasswordPolicyDefaultInstance()
+	policy.MaxAge = 24 * time.Hour
+	policy.HistorySize = 2
+	account := bson.M{
+		"Password":        "current",
+		"PasswordCreated": time.Now().Add(-48 * time.Hour).Format(time.RFC3339Nano),
+		"PasswordHistory": []interface{}{"previous", "oldest"},
+	}
+	if !policy.IsExpired(account) {
+		t.Error("Have to return true for a password older than MaxAge")
+	}
+	account["PasswordCreated"] = time.Now().Format(time.RFC3339Nano)
+	if policy.IsExpired(account) {
+		t.Error("Have to return false for a fresh password")
+	}
+	if undated := (bson.M{"Password": "current"}); !policy.IsExpired(undated) || GetPasswordPolicyDefaultInstance().IsExpired(undated) {
+		t.Error("Have to return true for a password of unknown age only when MaxAge is set")
+	}
+	if !policy.IsExpired(bson.M{"PasswordCreated": "yesterday"}) || !policy.IsExpired(bson.M{"PasswordCreated": time.Time{}.Format(time.RFC3339Nano)}) {
+		t.Error("Have to return true for an unparsable or zero PasswordCreated")
+	}
+	account["MustChangePassword"] = true
+	if !policy.IsExpired(account) {
+		t.Error("Have to return true for a forced password change")
+	}
+	if !policy.IsReused(account, "current") || !policy.IsReused(account, "oldest") || policy.IsReused(account, "new") {
+		t.Error("Have to detect reuse of current and stored passwords only")
+	}
+	if history := policy.NextHistory(account); len(history) != 2 || history[0] != "current" || history[1] != "previous" {
+		t.Errorf("Have to return [current previous] instead of %v", history)
+	}
+}
+
+func MockGetPage(filter interface{}, findOptions FindOptions, config interface{}) ([]byte, int64, error) {
+	bytes, err := MockGet(filter, config)
+	return bytes, findOptions.Skip + 1, err
+}
+
+func TestGetPageDocument(t *testing.T) {
+	FM.GetPageFunction = MockGetPage
+	result, total, err := FM.GetPage(bson.M{"FirstName": "Packard"}, FindOptions{Skip: 10, Limit: 10})
+	if err != nil {
+		t.Errorf("Something went wrong: %s", err)
+	}
+	if total != 11 {
+		t.Errorf("Have to return total 11 instead of %d", total)
+	}
+	if val, ok := result[0]["FirstName"]; val != "Packard" || !ok {
+		t.Errorf("Didn't get expected values; FistName: %s, ok: %v", val, ok)
+	}
+}
+
+func TestConverttoApiUsers(t *testing.T) {
+	users, err := ConverttoApiUsers([]bson.M{{"Team": "System", "Name": "admin", "Password": "hash"}})
+	if err != nil {
+		t.Errorf("Something went wrong: %s", err)
+	}
+	bytes, _ := json.Marshal(users)
+	if strings.Contains(string(bytes), "hash") {
+		t.Errorf("Password hash must not be returned: %s", bytes)
+	}
+}
+
+func TestTeamExists(t *testing.T) {
+	teamFM := TeamFM
+	t.Cleanup(func() { TeamFM = teamFM })
+	TeamFM = GetFileManagerDefaultInstace(commonconfig{})
+	TeamFM.GetFunction = func(filter interface{}, config interface{}) ([]byte, error) {
+		if filter.(bson.M)["Name"] == "Payments" {
+			return MockGet(filter, config)
+		}
+		return []byte("[]"), nil
+	}
+	if exists, err := TeamExists(context.Background(), SystemTeam); !exists || err != nil {
+		t.Errorf("Have to return true for the system team; err: %v", err)
+	}
+	if exists, err := TeamExists(context.Background(), "Payments"); !exists || err != nil {
+		t.Errorf("Have to return true for a stored team; err: %v", err)
+	}
+	if exists, err := TeamExists(context.Background(), "Paymnets"); exists || err != nil {
+		t.Errorf("Have to return false for a missing team; err: %v", err)
+	}
+}
+
+func TestDocumentDiff(t *testing.T) {
+	before := bson.M{"_id": "1", "Name": "errors", "HoldTime": 5, "Password": "old"}
+	after := bson.M{"_id": "1", "Name": "errors", "HoldTime": 10, "LogLogic": "AND", "Password": "new", "UpdateType": "Update"}
+	changes := DocumentDiff(before, after)
+	if len(changes) != 3 {
+		t.Errorf("Have to return 3 changes instead of %v", changes)
+	}
+	if change := changes["HoldTime"]; change.Before != 5 || change.After != 10 {
+		t.Errorf("Didn't get expected HoldTime change: %v", change)
+	}
+	if change := changes["LogLogic"]; change.Before != nil || change.After != "AND" {
+		t.Errorf("Didn't get expected LogLogic change: %v", change)
+	}
+	if change := changes["Password"]; change.Before != "<redacted>" || change.After != "<redacted>" {
+		t.Errorf("Password have to be redacted instead of %v", change)
+	}
+}
+
+func TestConfigSnapshot(t *testing.T) {
+	snapshot := ConfigSnapshot(bson.M{"_id": "1", "Name": "errors", "Team": "Payments", "UpdateType": "Update", "UpdateTime": time.Now()})
+	if len(snapshot) != 2 || snapshot["Name"] != "errors" || snapshot["Team"] != "Payments" {
+		t.Errorf("Have to keep only configuration fields instead of %v", snapshot)
+	}
+}
+
+func TestGetIfMatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := map[string]struct {
+		revision int
+		provided bool
+		failed   bool
+	}{
+		"":         {0, false, false},
+		"*":        {AnyRevision, true, false},
+		ETag(3):    {3, true, false},
+		`W/"7"`:    {7, true, false},
+		`"latest"`: {0, true, true},
+	}
+	for header, expected := range cases {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("PUT", "/api/1/config", nil)
+		c.Request.Header.Set("If-Match", header)
+		revision, provided, err := GetIfMatch(c)
+		if revision != expected.revision || provided != expected.provided || (err != nil) != expected.failed {
+			t.Errorf("If-Match %s: got %d, %v, %v", header, revision, provided, err)
+		}
+	}
+}
+
+func TestPlanConfigChanges(t *testing.T) {
+	base := TeamConfig{Name: "errors", LogSeverity: "Error", LogLogic: "AND", NotificationMethod: "Mail", NotificationRecipient: []string{"ops@example.com"}, HoldTime: 5}
+	changed := base
+	changed.HoldTime = 10
+	created := base
+	created.Name = "warnings"
+	removed := base
+	removed.Name = "debug"
+	unchanged := base
+	unchanged.Name = "fatal"
+	unchanged.Revision = 4
+	stored := []TeamConfig{base, removed, {Name: "fatal", LogSeverity: "Error", LogLogic: "AND", NotificationMethod: "Mail", NotificationRecipient: []string{"ops@example.com"}, HoldTime: 5}}
+	plan, err := PlanConfigChanges([]TeamConfig{changed, created, unchanged}, stored, "Payments", true)
+	if err != nil {
+		t.Errorf("Something went wrong: %s", err)
+	}
+	expected := map[string]string{"debug": "Delete", "errors": "Update", "fatal": "NoOp", "warnings": "Create"}
+	if len(plan) != len(expected) {
+		t.Errorf("Have to return %d plan items instead of %v", len(expected), plan)
+	}
+	for _, item := range plan {
+		if expected[item.Name] != item.Action {
+			t.Errorf("Have to %s %s instead of %s", expected[item.Name], item.Name, item.Action)
+		}
+	}
+	if change := plan[1].Changes["HoldTime"]; change.Before != 5.0 || change.After != 10.0 {
+		t.Errorf("Didn't get expected HoldTime change: %v", change)
+	}
+	plan, _ = PlanConfigChanges([]TeamConfig{changed}, stored, "Payments", false)
+	if len(plan) != 1 {
+		t.Errorf("Have to keep missing configurations without prune instead of %v", plan)
+	}
+}
+
+func TestValidateConfigBundle(t *testing.T) {
+	config := TeamConfig{Name: "errors", LogSeverity: "Error", LogLogic: "AND", NotificationMethod: "Mail", NotificationRecipient: []string{"ops@example.com"}}
+	if err := ValidateConfigBundle(ConfigBundle{Configs: []TeamConfig{config}}, "Payments"); err != nil {
+		t.Errorf("Have to accept a valid bundle: %s", err)
+	}
+	if err := ValidateConfigBundle(ConfigBundle{Team: "Billing", Configs: []TeamConfig{config}}, "Payments"); err == nil {
+		t.Error("Have to reject a bundle of another team")
+	}
+	if err := ValidateConfigBundle(ConfigBundle{Configs: []TeamConfig{config, config}}, "Payments"); err == nil {
+		t.Error("Have to reject duplicated configuration names")
+	}
+	config.NotificationRecipient = nil
+	if err := ValidateConfigBundle(ConfigBundle{Configs: []TeamConfig{config}}, "Payments"); err == nil {
+		t.Error("Have to reject a configuration without recipients")
+	}
+}
+
+func TestSyncOperations(t *testing.T) {
+	stored := []TeamConfig{{Name: "errors", HoldTime: 5, Revision: 2}, {Name: "debug"}}
+	desired := []TeamConfig{{Name: "errors", HoldTime: 10}, {Name: "warnings"}}
+	plan, err := PlanConfigChanges(desired, stored, "Payments", true)
+	if err != nil {
+		t.Errorf("Something went wrong: %s", err)
+	}
+	operations, documents, err := SyncOperations(plan, desired, stored, "Payments")
+	if err != nil {
+		t.Errorf("Something went wrong: %s", err)
+	}
+	actions := []string{}
+	for _, operation := range operations {
+		actions = append(actions, operation.Action)
+	}
+	if strings.Join(actions, ",") != "Delete,Update,Insert" {
+		t.Errorf("Have to return Delete,Update,Insert operations instead of %v", actions)
+	}
+	if filter := operations[1].Filter.(bson.M); filter["Revision"] != 2 {
+		t.Errorf("Have to update only the planned revision instead of %v", filter)
+	}
+	if filter := operations[0].Filter.(bson.M); filter["Revision"] == nil {
+		t.Errorf("Have to delete only the planned revision instead of %v", filter)
+	}
+	if documents["errors"]["Revision"] != 3 || documents["warnings"]["Team"] != "Payments" {
+		t.Errorf("Didn't get expected published documents: %v", documents)
+	}
+	first, _ := GetPlanID(plan)
+	plan[0].Action = "NoOp"
+	if second, _ := GetPlanID(plan); first == second {
+		t.Error("Have to return another plan id for a changed plan")
+	}
+}
+
+func TestApplyConfigPlanOnlyChangesPlannedRevisions(t *testing.T) {
+	stores := useMemoryStores(t)
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/api/1/config/import", nil)
+	stores.configs = []bson.M{{"Name": "errors", "Team": "Ops", "HoldTime": 5, "Revision": 3}, {"Name": "debug", "Team": "Ops", "Revision": 3}}
+	stored := []TeamConfig{{Name: "errors", HoldTime: 5, Revision: 2}, {Name: "debug", Revision: 2}}
+	desired := []TeamConfig{{Name: "errors", HoldTime: 10}}
+	plan, _ := PlanConfigChanges(desired, stored, "Ops", true)
+	for _, item := range plan {
+		err := ApplyConfigPlan(c, "Ops", []PlanItem{item}, desired, stored)
+		if !errors.Is(err, ErrConflict) {
+			t.Errorf("Have to refuse to %s a configuration changed after the plan instead of %v", item.Action, err)
+		}
+	}
+	if len(stores.configs) != 2 || fmt.Sprint(stores.configs[0]["HoldTime"]) != "5" {
+		t.Errorf("Have to keep configurations changed after the plan: %v", stores.configs)
+	}
+	router := NewRouter()
+	imported := requestAs(router, "ops-bot", "POST", "/api/1/config/import", `{"Configs": [{"Name": "errors", "HoldTme": 10}]}`)
+	if imported.Code != 400 {
+		t.Errorf("Have to reject a bundle with unknown fields instead of %d", imported.Code)
+	}
+}
+
+func TestRunClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if user != "deployer" || password != "S3cret!pass" {
+			w.WriteHeader(403)
+			w.Write([]byte(`{"Status": false, "Message": "Not authecticated"}`))
+			return
+		}
+		if r.URL.Path == "/api/1/config" {
+			w.Write([]byte(`[{"Name": "errors", "Team": "Payments", "NotificationRecipient": ["ops@example.com"], "Revision": 2}]`))
+			return
+		}
+		w.WriteHeader(404)
+		w.Write([]byte(`{"Status": false, "Message": "no configuration found with name: debug"}`))
+	}))
+	defer server.Close()
+	t.Setenv("LOG2N_URL", server.URL)
+	t.Setenv("LOG2N_USER", "deployer")
+	t.Setenv("LOG2N_PASSWORD", "S3cret!pass")
+	profiles := t.TempDir() + "/profiles.yaml"
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if code := RunClient([]string{"-profiles", profiles, "config", "list"}, nil, stdout, stderr); code != exitOK {
+		t.Errorf("Have to return %d instead of %d: %s", exitOK, code, stderr)
+	}
+	if !strings.Contains(stdout.String(), "errors") || !strings.Contains(stdout.String(), "ops@example.com") {
+		t.Errorf("Didn't get expected table output: %s", stdout)
+	}
+	if code := RunClient([]string{"-profiles", profiles, "config", "get", "debug"}, nil, stdout, stderr); code != exitNotFound {
+		t.Errorf("Have to return %d instead of %d", exitNotFound, code)
+	}
+	t.Setenv("LOG2N_PASSWORD", "wrong")
+	if code := RunClient([]string{"-profiles", profiles, "-o", "json", "config", "list"}, nil, stdout, stderr); code != exitNotAuthorized {
+		t.Errorf("Have to return %d instead of %d", exitNotAuthorized, code)
+	}
+	if code := RunClient([]string{"-profiles", profiles, "config", "rename"}, nil, stdout, stderr); code != exitUsage {
+		t.Errorf("Have to return %d instead of %d", exitUsage, code)
+	}
+}
+
+func TestValidateConfigCommand(t *testing.T) {
+	dir := t.TempDir()
+	secret := dir + "/secret"
+	os.WriteFile(secret, []byte("mongodb://localhost:27017\nignored"), 0600)
+	for name, value := range map[string]string{
+		"configdb": "log2n", "ConfigCol": "configs", "configDBCS": secret, "userDBCS": secret,
+		"userdb": "log2n", "userCol": "users", "QCS": secret, "QName": "configs", "QServerAddress": "localhost:5672",
+	} {
+		t.Setenv(name, value)
+	}
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if code := RunCommand([]string{"validate-config"}, nil, stdout, stderr); code != exitOK {
+		t.Errorf("Have to return %d instead of %d: %s", exitOK, code, stderr)
+	}
+	if strings.Contains(stdout.String(), "mongodb://") {
+		t.Errorf("Connection strings must not be printed: %s", stdout)
+	}
+	t.Setenv("pwdMinLength", "many")
+	if code := RunCommand([]string{"validate-config"}, nil, stdout, stderr); code != exitError {
+		t.Errorf("Have to return %d instead of %d", exitError, code)
+	}
+}
+
+func TestMigrationVersions(t *testing.T) {
+	previous := 0
+	for _, migration := range Migrations {
+		if migration.Version <= previous {
+			t.Errorf("migration %d must have a higher version than %d", migration.Version, previous)
+		}
+		if migration.Description == "" || migration.Apply == nil {
+			t.Errorf("migration %d must have a description and an apply function", migration.Version)
+		}
+		previous = migration.Version
+	}
+}
+
+func TestTeamsMigration(t *testing.T) {
+	configFM, userFM, teamFM := ConfigFM, UserFM, TeamFM
+	t.Cleanup(func() { ConfigFM, UserFM, TeamFM = configFM, userFM, teamFM })
+	configs := []bson.M{{"Team": "Ops", "Name": "errors"}, {"Team": "Ops", "Name": "warnings"}, {"Team": "Dev", "Name": "errors"}}
+	users := []bson.M{{"Name": "admin", "Team": SystemTeam}, {"Name": "qa-bot", "Team": "QA"}, {"Name": "dev-bot", "Team": "Dev"}}
+	teams := []bson.M{}
+	ConfigFM, UserFM, TeamFM = memoryFileManager(&configs), memoryFileManager(&users), memoryFileManager(&teams)
+	for _, migration := range Migrations {
+		if migration.Version == 6 {
+			if err := migration.Apply(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	names := []string{}
+	for _, team := range teams {
+		names = append(names, fmt.Sprint(team["Name"]))
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[Dev Ops QA]" {
+		t.Errorf("expected one team per distinct team of configurations and users, got %v", names)
+	}
+}
+
+func TestPasswordAgeMigration(t *testing.T) {
+	stores := useMemoryStores(t)
+	created := time.Now().Add(-time.Hour).Format(time.RFC3339Nano)
+	stores.users[0]["PasswordCreated"] = created
+	for _, migration := range Migrations {
+		if migration.Version == 7 {
+			if err := migration.Apply(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	policy := PasswordPolicy{MaxAge: 24 * time.Hour}
+	if stores.users[0]["PasswordCreated"] != created {
+		t.Error("dated passwords must keep their age")
+	}
+	if _, ok := stores.users[1]["PasswordCreated"]; !ok || policy.IsExpired(stores.users[1]) {
+		t.Errorf("undated passwords must be dated by the migration, got %v", stores.users[1])
+	}
+}
+
+func TestPublishConfigChangeRequiresKey(t *testing.T) {
+	cm := CM
+	t.Cleanup(func() { CM = cm })
+	sent := []interface{}{}
+	CM = GetBreakerOverloadInstance(func(message interface{}) error {
+		sent = append(sent, message)
+		return nil
+	})
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Set("RequestID", "req-1")
+	if err := PublishConfigChange(c, bson.M{"Name": "errors"}, "Delete"); err == nil {
+		t.Error("event without Team must be refused")
+	}
+	if err := PublishConfigChange(c, bson.M{"Team": "Ops", "Name": "errors"}, "Delete"); err != nil {
+		t.Error(err)
+	}
+	if len(sent) != 1 || sent[0].(eventmessage).Event["RequestID"] != "req-1" {
+		t.Errorf("expected one published event with the request ID, got %v", sent)
+	}
+}
+
+func TestConfigFilter(t *testing.T) {
+	filter := ConfigFilter("Ops", bson.M{"ID": "abc", "Name": "renamed"})
+	if filter["ID"] != "abc" || filter["Team"] != "Ops" || filter["Name"] != nil {
+		t.Errorf("expected a filter by ID, got %v", filter)
+	}
+	filter = ConfigFilter("Ops", bson.M{"Name": "errors"})
+	if filter["Name"] != "errors" || filter["Team"] != "Ops" {
+		t.Errorf("expected a filter by name, got %v", filter)
+	}
+	if first, second := NewConfigID(), NewConfigID(); first == "" || first == second {
+		t.Errorf("expected unique configuration IDs, got %s and %s", first, second)
+	}
+}
+
+func TestRespondError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := []struct {
+		err     error
+		message string
+		status  int
+		code    string
+		shown   string
+	}{
+		{Invalid(fmt.Errorf("bad field")), "bad field", 400, "invalid_request", "bad field"},
+		{StorageError(mongo.ErrNoDocuments), "no configuration found", 404, "not_found", "no configuration found"},
+		{fmt.Errorf("AddTeamConfig: %w", ErrDuplicate), "already exist", 409, "duplicate", "already exist"},
+		{fmt.Errorf("%w: broker down", ErrUnavailable), "not shown", 503, "unavailable", "Service is temporarily unavailable. Please retry later"},
+		{fmt.Errorf("unexpected"), "not shown", 500, "internal_error", "Unhandled exception. Please contact to Administrator"},
+	}
+	for _, tc := range cases {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest("GET", "/api/1/config", nil)
+		c.Request.Header.Set("X-Request-ID", "req-1")
+		RequestID(c)
+		RespondError(c, tc.err, tc.message)
+		response := httpresponse{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if recorder.Code != tc.status || response.Code != tc.code || response.Message != tc.shown || response.RequestID != "req-1" {
+			t.Errorf("%v: got %d %+v", tc.err, recorder.Code, response)
+		}
+	}
+}
+
+func TestConfigChanges(t *testing.T) {
+	stored := bson.M{"Team": "Ops", "Name": "errors", "ID": "abc", "Revision": 3, "HoldTime": 5.0, "NotificationRecipient": bson.A{"ops@example.com"}}
+	if changes := ConfigChanges(stored, bson.M{"Team": "Ops", "Name": "errors", "HoldTime": 5, "NotificationRecipient": []interface{}{"ops@example.com"}}); len(changes) != 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+	changes := ConfigChanges(stored, bson.M{"Team": "Ops", "Name": "errors", "HoldTime": 10})
+	if len(changes) != 1 || changes["HoldTime"].After == nil {
+		t.Errorf("expected HoldTime change, got %v", changes)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Metrics)
+	router.GET("/api/1/config/:name", func(c *gin.Context) { c.Status(404) })
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/1/config/errors", nil))
+	ObserveStorage("config", "Get", time.Now(), ErrNotFound)
+	ObservePublish("Add", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		`log2n_config_http_requests_total{method="GET",route="/api/1/config/:name",status="404"} 1`,
+		`log2n_config_storage_operation_duration_seconds_count{operation="Get",outcome="not_found",store="config"} 1`,
+		`log2n_config_event_publish_total{outcome="success",type="Add"} 1`,
+		`log2n_config_breaker_state{state="Closed"}`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("metrics do not contain %s", expected)
+		}
+	}
+}
+
+func TestGetReadiness(t *testing.T) {
+	result := GetReadiness([]dependencycheck{
+		{Name: "mongodb:config.configs", Check: func() error { return nil }},
+		{Name: "rabbitmq:configs", Check: func() error { return fmt.Errorf("connection refused") }},
+	})
+	if result.Ready {
+		t.Error("service must not be ready when a dependency is down")
+	}
+	if result.Dependencies["mongodb:config.configs"].Status != "up" || result.Dependencies["rabbitmq:configs"].Error != "connection refused" {
+		t.Errorf("unexpected dependency status: %+v", result.Dependencies)
+	}
+	if result := GetReadiness([]dependencycheck{{Name: "breaker", Check: func() error { return nil }}}); !result.Ready {
+		t.Error("service must be ready when all dependencies are up")
+	}
+}
+
+func TestCachedCheck(t *testing.T) {
+	calls := 0
+	check := cachedCheck(t.Name(), func() error {
+		calls++
+		return fmt.Errorf("connection refused")
+	})
+	var wait sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if err := check(); err == nil {
+				t.Error("the cached error must be returned")
+			}
+		}()
+	}
+	wait.Wait()
+	if calls != 1 {
+		t.Errorf("expected one check within the cache lifetime, got %d", calls)
+	}
+}
+
+func TestCheckQueueTimeout(t *testing.T) {
+	// accepts connections but never answers the AMQP handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			<-done
+			conn.Close()
+		}
+	}()
+	start := time.Now()
+	err = CheckQueue(commonconfig{qconfig: qconfig{QConnectionString: "amqp://guest:guest@" + listener.Addr().String(), QName: "configs"}})
+	if err == nil || time.Since(start) > queueCheckTimeout+time.Second {
+		t.Errorf("expected the check to fail within %s, got %v after %s", queueCheckTimeout, err, time.Since(start))
+	}
+}
+
+func TestLoggerRedaction(t *testing.T) {
+	out := bytes.Buffer{}
+	logger := NewLogger(&out, slog.LevelInfo)
+	logger.Info("user changed", "Password", "secret", "user", bson.M{"Name": "admin", "PasswordHistory": bson.A{"hash"}, "Nested": bson.M{"Password": "hash"}})
+	logger.Debug("not written")
+	if strings.Contains(out.String(), "secret") || strings.Contains(out.String(), "hash") || strings.Contains(out.String(), "not written") {
+		t.Errorf("log contains sensitive or filtered output: %s", out.String())
+	}
+	if !strings.Contains(out.String(), `"Name":"admin"`) {
+		t.Errorf("log lost non sensitive fields: %s", out.String())
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("unknown log level must be refused")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	propagator, configFM, cm := otel.GetTextMapPropagator(), ConfigFM, CM
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagator)
+		ConfigFM, CM = configFM, cm
+	})
+	ConfigFM = GetFileManagerDefaultInstace(commonconfig{})
+	ConfigFM.Name = "config"
+	ConfigFM.GetFunction = func(filter interface{}, config interface{}) ([]byte, error) {
+		return []byte("[]"), nil
+	}
+	sent := []interface{}{}
+	CM = GetBreakerOverloadInstance(func(message interface{}) error {
+		sent = append(sent, message)
+		return nil
+	})
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(RequestID, Tracing)
+	router.DELETE("/api/1/config", func(c *gin.Context) {
+		ConfigFM.WithContext(RequestContext(c)).GetOne(bson.M{"Name": "errors"})
+		PublishConfigChange(c, bson.M{"Team": "Ops", "Name": "errors"}, "Delete")
+	})
+	request := httptest.NewRequest("DELETE", "/api/1/config", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+		if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("span %s must continue the incoming trace", span.Name())
+		}
+	}
+	server, ok := spans["DELETE /api/1/config"]
+	if !ok {
+		t.Fatalf("expected a span named by the route, got %v", spans)
+	}
+	for _, name := range []string{"storage.Get", "publish Delete"} {
+		if span, ok := spans[name]; !ok || span.Parent().SpanID() != server.SpanContext().SpanID() {
+			t.Errorf("expected %s as a child of the request span", name)
+		}
+	}
+	if len(sent) != 1 || !strings.Contains(sent[0].(eventmessage).Headers["traceparent"], "4bf92f3577b34da6a3ce929d0e0e4736") {
+		t.Errorf("expected the trace context in the message headers, got %v", sent)
+	}
+}
+
+func TestServeDrainsRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(201)
+	})}
+	shuttingDown := make(chan time.Time, 1)
+	server.RegisterOnShutdown(func() { shuttingDown <- time.Now() })
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, server, listener, 100*time.Millisecond, 5*time.Second)
+	}()
+	t.Cleanup(func() { draining.Store(false) })
+	status := make(chan int, 1)
+	go func() {
+		response, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			status <- 0
+			return
+		}
+		response.Body.Close()
+		status <- response.StatusCode
+	}()
+	<-started
+	cancelled := time.Now()
+	cancel()
+	shutdown := <-shuttingDown
+	if !draining.Load() {
+		t.Error("readiness must fail once shutdown starts")
+	}
+	if delay := shutdown.Sub(cancelled); delay < 100*time.Millisecond {
+		t.Errorf("connections must be accepted during the pre-stop delay, shutdown started after %s", delay)
+	}
+	close(release)
+	if code := <-status; code != 201 {
+		t.Errorf("in-flight request must complete during shutdown, got status %d", code)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+}
+
+func TestServeReturnsListenerErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	if err := Serve(context.Background(), &http.Server{}, listener, 0, time.Second); err == nil {
+		t.Error("a server which cannot accept connections must fail")
+	}
+}
+
+func TestShutdownStopsBreaker(t *testing.T) {
+	cm := CM
+	t.Cleanup(func() { CM = cm })
+	CM = GetBreakerOverloadInstance(func(message interface{}) error { return nil })
+	flushed := false
+	Shutdown(context.Background(), func(context.Context) error {
+		flushed = true
+		return nil
+	})
+	if err := CM.Do(bson.M{}); err == nil {
+		t.Error("stopped breaker must refuse to publish")
+	}
+	if !flushed {
+		t.Error("traces must be flushed on shutdown")
+	}
+}
+
+func writeTestCertificate(t *testing.T, dir string, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeTestCertificate(t, dir, "ca", &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test ca"}, NotAfter: notAfter, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil, nil)
+	serverTemplate := &x509.Certificate{SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "server"}, NotAfter: notAfter, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	writeTestCertificate(t, dir, "server", serverTemplate, ca, caKey)
+	writeTestCertificate(t, dir, "client", &x509.Certificate{SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "ops-bot"}, NotAfter: notAfter, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca, caKey)
+
+	tlsConfig, err := NewTLSConfig(tlsconfig{CertFile: filepath.Join(dir, "server.crt"), KeyFile: filepath.Join(dir, "server.key"), MinVersion: tls.VersionTLS12, ClientCAFile: filepath.Join(dir, "ca.crt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userFM := UserFM
+	t.Cleanup(func() { UserFM = userFM })
+	UserFM = GetFileManagerDefaultInstace(commonconfig{})
+	UserFM.GetFunction = func(filter interface{}, config interface{}) ([]byte, error) {
+		if filter.(bson.M)["Name"] == "ops-bot" {
+			return []byte(`[{"Name": "ops-bot", "Team": "Ops"}]`), nil
+		}
+		return []byte("[]"), nil
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/whoami", Authenticate, func(c *gin.Context) {
+		c.String(200, GetUserName(c)+"@"+c.Params.ByName("Team"))
+	})
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: router}
+	go server.Serve(listener)
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(certificates []tls.Certificate) (*http.Response, string) {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true, TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: certificates}}}
+		response, err := client.Get("https://" + listener.Addr().String() + "/whoami")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response, string(body)
+	}
+	if response, body := get([]tls.Certificate{clientCert}); response.StatusCode != 200 || body != "ops-bot@Ops" {
+		t.Errorf("client certificate must authenticate as its account, got %d %s", response.StatusCode, body)
+	}
+	if response, _ := get(nil); response.StatusCode != 401 {
+		t.Errorf("request without certificate or password must be refused, got %d", response.StatusCode)
+	}
+
+	serverTemplate.SerialNumber = big.NewInt(4)
+	writeTestCertificate(t, dir, "server", serverTemplate, ca, caKey)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "server.crt"), future, future)
+	if response, _ := get([]tls.Certificate{clientCert}); response.TLS.PeerCertificates[0].SerialNumber.Int64() != 4 {
+		t.Error("rotated server certificate must be served without restart")
+	}
+}
+
+func TestSecretStore(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "configdbcs")
+	os.WriteFile(file, []byte("mongodb://old@db\nignored\n"), 0600)
+	t.Setenv("TEST_QCS", "guest:guest")
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" || r.URL.Path != "/v1/secret/data/log2n" {
+			w.WriteHeader(403)
+			return
+		}
+		w.Write([]byte(`{"data": {"data": {"userdb": "mongodb://vault@db"}, "metadata": {"version": 1}}}`))
+	}))
+	defer vault.Close()
+	previous := Secrets
+	defer func() { Secrets = previous }()
+	Secrets = NewSecretStore(map[string]secretsource{"file": FileSecret, "env": EnvSecret, "vault": VaultSecret(vault.URL, "root", vault.Client())})
+	for name, expected := range map[string][]string{
+		"configDBCS": {file, "mongodb://old@db"},
+		"userDBCS":   {"vault:secret/data/log2n#userdb", "mongodb://vault@db"},
+		"QCS":        {"env:TEST_QCS", "guest:guest"},
+	} {
+		if value, err := Secrets.Add(name, expected[0]); err != nil || value != expected[1] {
+			t.Errorf("expected %s from %s, got %q %v", expected[1], expected[0], value, err)
+		}
+	}
+	if _, err := Secrets.Add("missing", "vault:secret/data/log2n#missing"); err == nil {
+		t.Error("missing vault field must fail")
+	}
+	conf := DBConfig{Connectionstring: "mongodb://old@db", ConnectionSecret: "configDBCS"}
+	queue := qconfig{QServerAddress: "mq:5672", QSecret: "QCS"}
+	os.WriteFile(file, []byte("mongodb://new@db\n"), 0600)
+	t.Setenv("TEST_QCS", "app:rotated")
+	rotated := Secrets.Refresh()
+	if len(rotated) != 2 {
+		t.Errorf("expected the file and env secrets to rotate, got %v", rotated)
+	}
+	if conf.ConnectionURI() != "mongodb://new@db" || queue.QURI() != "amqp://app:rotated@mq:5672" {
+		t.Errorf("connections must use rotated secrets, got %s and %s", conf.ConnectionURI(), queue.QURI())
+	}
+	os.Remove(file)
+	Secrets.Refresh()
+	if conf.ConnectionURI() != "mongodb://new@db" {
+		t.Error("unreadable secret must keep its previous value")
+	}
+}
+
+func TestFileManagersUseRotatedSecrets(t *testing.T) {
+	global, secrets := GlobalConfig, Secrets
+	configFM, userFM, teamFM, auditFM, revisionFM, migrationFM := ConfigFM, UserFM, TeamFM, AuditFM, RevisionFM, MigrationFM
+	t.Cleanup(func() {
+		GlobalConfig, Secrets = global, secrets
+		ConfigFM, UserFM, TeamFM, AuditFM, RevisionFM, MigrationFM = configFM, userFM, teamFM, auditFM, revisionFM, migrationFM
+	})
+	secret := filepath.Join(t.TempDir(), "configdbcs")
+	os.WriteFile(secret, []byte("mongodb://old@db\n"), 0600)
+	for name, value := range map[string]string{
+		"configdb": "log2n", "ConfigCol": "configs", "configDBCS": secret, "userDBCS": secret,
+		"userdb": "log2n", "userCol": "users", "QCS": secret, "QName": "configs", "QServerAddress": "localhost:5672",
+	} {
+		t.Setenv(name, value)
+	}
+	if err := getEnvs(); err != nil {
+		t.Fatal(err)
+	}
+	initFileManagers()
+	os.WriteFile(secret, []byte("mongodb://new@db\n"), 0600)
+	Secrets.Refresh()
+	for _, fm := range []FileManager{ConfigFM, UserFM, TeamFM, AuditFM, RevisionFM, MigrationFM} {
+		if uri := fm.config.(commonconfig).ConnectionURI(); uri != "mongodb://new@db" {
+			t.Errorf("%s store must connect with the rotated secret, got %s", fm.Name, uri)
+		}
+	}
+}
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	documented := map[string]bool{}
+	for _, operation := range apiOperations {
+		documented[operation.Method+" "+operation.Path] = true
+	}
+	router := NewRouter()
+	for _, route := range router.Routes() {
+		key := route.Method + " " + route.Path
+		if !documented[key] {
+			t.Errorf("route %s is missing from the OpenAPI document", key)
+		}
+		delete(documented, key)
+	}
+	for key := range documented {
+		t.Errorf("OpenAPI document describes %s which is not routed", key)
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	document := struct {
+		Paths      map[string]map[string]interface{}
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]interface{}
+			}
+		}
+	}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &document); err != nil || recorder.Code != 200 {
+		t.Fatalf("expected the document as JSON, got %d %v", recorder.Code, err)
+	}
+	if _, ok := document.Paths["/api/1/config/{name}/revisions/{revision}"]["get"]; !ok {
+		t.Error("path parameters must use the OpenAPI syntax")
+	}
+	config := document.Components.Schemas["TeamConfig"].Properties
+	if config["NotificationRecipient"]["type"] != "array" || config["HoldTime"]["type"] != "integer" {
+		t.Errorf("TeamConfig schema must follow the struct fields, got %v", config)
+	}
+	if _, ok := document.Components.Schemas["httpresponse"].Properties["RequestID"]; !ok {
+		t.Error("httpresponse schema must list RequestID")
+	}
+	change := document.Components.Schemas["configchangerequest"].Properties
+	if _, ok := change["Revision"]; ok || change["ID"] == nil || change["LogSeverity"] == nil {
+		t.Errorf("request schemas must only list the accepted fields including embedded ones, got %v", change)
+	}
+	if user := document.Components.Schemas["userrequest"].Properties; user["PasswordHistory"] != nil || user["Password"] == nil {
+		t.Errorf("user request schema must not list stored fields, got %v", user)
+	}
+}
+
+// memoryFileManager keeps documents in memory, filters match by equality of their fields, $in or $exists, updates support $set, $inc and $unset
+func memoryFileManager(documents *[]bson.M) FileManager {
+	normalize := func(in interface{}) bson.M {
+		document := bson.M{}
+		bytes, _ := json.Marshal(in)
+		json.Unmarshal(bytes, &document)
+		return document
+	}
+	matches := func(document bson.M, filter interface{}) bool {
+		for key, value := range filter.(bson.M) {
+			if operator, ok := value.(bson.M); ok {
+				if exists, ok := operator["$exists"].(bool); ok {
+					if _, found := document[key]; found != exists {
+						return false
+					}
+					continue
+				}
+				found := false
+				for _, candidate := range operator["$in"].(bson.A) {
+					found = found || fmt.Sprint(document[key]) == fmt.Sprint(candidate) || (candidate == nil && document[key] == nil)
+				}
+				if !found {
+					return false
+				}
+				continue
+			}
+			if fmt.Sprint(document[key]) != fmt.Sprint(value) {
+				return false
+			}
+		}
+		return true
+	}
+	find := func(filter interface{}) []bson.M {
+		found := []bson.M{}
+		for _, document := range *documents {
+			if matches(document, filter) {
+				found = append(found, document)
+			}
+		}
+		return found
+	}
+	less := func(a bson.M, b bson.M, sort bson.D) bool {
+		for _, key := range sort {
+			x, y := fmt.Sprint(a[key.Key]), fmt.Sprint(b[key.Key])
+			if xn, ok := a[key.Key].(float64); ok {
+				if yn, ok := b[key.Key].(float64); ok {
+					x, y = fmt.Sprintf("%020.3f", xn), fmt.Sprintf("%020.3f", yn)
+				}
+			}
+			if x != y {
+				return (x < y) == (fmt.Sprint(key.Value) != "-1")
+			}
+		}
+		return false
+	}
+	apply := func(document bson.M, update interface{}) {
+		for _, operation := range update.(bson.D) {
+			for key, value := range normalize(operation.Value) {
+				switch operation.Key {
+				case "$set":
+					document[key] = value
+				case "$inc":
+					current, _ := document[key].(float64)
+					document[key] = current + value.(float64)
+				case "$unset":
+					delete(document, key)
+				}
+			}
+		}
+	}
+	fm := GetFileManagerDefaultInstace(commonconfig{})
+	fm.GetFunction = func(filter interface{}, config interface{}) ([]byte, error) {
+		return json.Marshal(find(filter))
+	}
+	fm.GetPageFunction = func(filter interface{}, findOptions FindOptions, config interface{}) ([]byte, int64, error) {
+		found := find(filter)
+		sort.SliceStable(found, func(i int, j int) bool { return less(found[i], found[j], findOptions.Sort) })
+		total := int64(len(found))
+		found = found[min(findOptions.Skip, total):]
+		if findOptions.Limit > 0 {
+			found = found[:min(findOptions.Limit, int64(len(found)))]
+		}
+		page := []bson.M{}
+		for _, document := range found {
+			projected := bson.M{}
+			for key, value := range document {
+				if fmt.Sprint(findOptions.Projection[key]) != "0" {
+					projected[key] = value
+				}
+			}
+			page = append(page, projected)
+		}
+		bytes, err := json.Marshal(page)
+		return bytes, total, err
+	}
+	fm.InsertFunction = func(insert interface{}, config interface{}) error {
+		*documents = append(*documents, normalize(insert))
+		return nil
+	}
+	fm.UpdateFunction = func(filter interface{}, update interface{}, config interface{}) error {
+		found := find(filter)
+		if len(found) == 0 {
+			return ErrNotFound
+		}
+		before, _ := json.Marshal(found[0])
+		apply(found[0], update)
+		if after, _ := json.Marshal(found[0]); string(before) == string(after) {
+			return ErrNoChange
+		}
+		return nil
+	}
+	fm.UpdateManyFunction = func(filter interface{}, update interface{}, config interface{}) error {
+		for _, document := range find(filter) {
+			apply(document, update)
+		}
+		return nil
+	}
+	fm.UpdateAndGetFunction = func(filter interface{}, update interface{}, config interface{}) ([]byte, error) {
+		found := find(filter)
+		if len(found) == 0 {
+			return nil, ErrNotFound
+		}
+		apply(found[0], update)
+		return json.Marshal(found[0])
+	}
+	fm.DeleteFunction = func(filter interface{}, config interface{}) error {
+		kept := []bson.M{}
+		for _, document := range *documents {
+			if !matches(document, filter) {
+				kept = append(kept, document)
+			}
+		}
+		if len(kept) == len(*documents) {
+			return ErrNotFound
+		}
+		*documents = kept
+		return nil
+	}
+	fm.DeleteManyFunction = func(filter interface{}, config interface{}) error {
+		kept := []bson.M{}
+		for _, document := range *documents {
+			if !matches(document, filter) {
+				kept = append(kept, document)
+			}
+		}
+		*documents = kept
+		return nil
+	}
+	return fm
+}
+
+// memorystores holds the documents of the in-memory stores and the events published during a test
+type memorystores struct {
+	configs   []bson.M
+	users     []bson.M
+	teams     []bson.M
+	revisions []bson.M
+	audits    []bson.M
+	sent      []interface{}
+}
+
+// useMemoryStores replaces the stores, the publisher and the password policy until the test ends.
+// The Ops team has the user ops-bot and the system team the user admin, both with the password secret
+func useMemoryStores(t *testing.T) *memorystores {
+	configFM, userFM, teamFM, revisionFM, auditFM, cm, policy := ConfigFM, UserFM, TeamFM, RevisionFM, AuditFM, CM, GlobalConfig.PasswordPolicy
+	t.Cleanup(func() {
+		ConfigFM, UserFM, TeamFM, RevisionFM, AuditFM, CM, GlobalConfig.PasswordPolicy = configFM, userFM, teamFM, revisionFM, auditFM, cm, policy
+	})
+	stores := &memorystores{
+		users: []bson.M{{"Name": "ops-bot", "Team": "Ops", "Password": GetHash("secret")}, {"Name": "admin", "Team": SystemTeam, "Password": GetHash("secret")}},
+		teams: []bson.M{{"Name": "Ops"}},
+	}
+	ConfigFM, UserFM, TeamFM = memoryFileManager(&stores.configs), memoryFileManager(&stores.users), memoryFileManager(&stores.teams)
+	RevisionFM, AuditFM = memoryFileManager(&stores.revisions), memoryFileManager(&stores.audits)
+	GlobalConfig.PasswordPolicy = PasswordPolicy{}
+	CM = GetBreakerOverloadInstance(func(message interface{}) error {
+		stores.sent = append(stores.sent, message)
+		return nil
+	})
+	return stores
+}
+
+// requestAs sends a request with the Basic Auth credentials of user and the given headers
+func requestAs(router http.Handler, user string, method string, path string, body string, headers ...string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.SetBasicAuth(user, "secret")
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	router.ServeHTTP(recorder, r)
+	return recorder
+}
+
+func TestRollbackRestoresRemovedConfigID(t *testing.T) {
+	stores := useMemoryStores(t)
+	gin.SetMode(gin.TestMode)
+	router := NewRouter()
+	request := func(method string, path string, body string) *httptest.ResponseRecorder {
+		return requestAs(router, "ops-bot", method, path, body)
+	}
+
+	created := request("POST", "/api/2/teams/Ops/configs", `{"Name": "errors", "LogSeverity": "Error", "LogLogic": "Count", "NotificationMethod": "Mail", "NotificationRecipient": ["ops@example.com"]}`)
+	config := TeamConfig{}
+	json.Unmarshal(created.Body.Bytes(), &config)
+	if removed := request("DELETE", "/api/2/teams/Ops/configs/errors", ""); removed.Code != 204 {
+		t.Fatalf("expected the configuration to be removed, got %d %s", removed.Code, removed.Body)
+	}
+	for _, body := range []string{`{"Revision": "1"}`, `{"Revision": 1.5}`, `{"Revision": 0}`, `{}`} {
+		if invalid := request("POST", "/api/1/config/errors/rollback", body); invalid.Code != 400 {
+			t.Errorf("rollback with %s must answer 400, got %d", body, invalid.Code)
+		}
+	}
+	if missing := request("POST", "/api/1/config/errors/rollback", `{"Revision": 1000000}`); missing.Code != 404 {
+		t.Errorf("rollback to a large revision number must look it up, got %d %s", missing.Code, missing.Body)
+	}
+	if restored := request("POST", "/api/1/config/errors/rollback", `{"Revision": 1}`); restored.Code != 200 {
+		t.Fatalf("expected the configuration to be restored, got %d %s", restored.Code, restored.Body)
+	}
+	if len(stores.configs) != 1 || stores.configs[0]["ID"] != config.ID {
+		t.Errorf("restored configuration must keep its ID %s, got %v", config.ID, stores.configs)
+	}
+}
+
+func TestRollbackHonoursIfMatch(t *testing.T) {
+	useMemoryStores(t)
+	requireIfMatch := GlobalConfig.RequireIfMatch
+	t.Cleanup(func() { GlobalConfig.RequireIfMatch = requireIfMatch })
+	gin.SetMode(gin.TestMode)
+	router := NewRouter()
+	request := func(method string, path string, body string, headers ...string) *httptest.ResponseRecorder {
+		return requestAs(router, "ops-bot", method, path, body, headers...)
+	}
+
+	request("POST", "/api/2/teams/Ops/configs", `{"Name": "errors", "LogSeverity": "Error", "LogLogic": "Count", "NotificationMethod": "Mail", "NotificationRecipient": ["ops@example.com"]}`)
+	request("PUT", "/api/2/teams/Ops/configs/errors", `{"HoldTime": 5}`)
+	GlobalConfig.RequireIfMatch = true
+	if required := request("POST", "/api/1/config/errors/rollback", `{"Revision": 1}`); required.Code != 428 {
+		t.Errorf("rollback without If-Match must answer 428 when it is required, got %d", required.Code)
+	}
+	if stale := request("POST", "/api/1/config/errors/rollback", `{"Revision": 1}`, "If-Match", `"1"`); stale.Code != 412 {
+		t.Errorf("rollback with a stale If-Match must answer 412, got %d", stale.Code)
+	}
+	if restored := request("POST", "/api/1/config/errors/rollback", `{"Revision": 1}`, "If-Match", `"2"`); restored.Code != 200 || restored.Header().Get("ETag") != `"3"` {
+		t.Errorf("rollback with the current If-Match must answer 200 with the new ETag, got %d %s", restored.Code, restored.Header())
+	}
+	request("DELETE", "/api/2/teams/Ops/configs/errors", "", "If-Match", "*")
+	if missing := request("POST", "/api/1/config/errors/rollback", `{"Revision": 1}`, "If-Match", "*"); missing.Code != 412 {
+		t.Errorf("If-Match on a removed configuration must answer 412, got %d", missing.Code)
+	}
+	if recreated := request("POST", "/api/1/config/errors/rollback", `{"Revision": 1}`); recreated.Code != 200 {
+		t.Errorf("a removed configuration must be restored without If-Match, got %d %s", recreated.Code, recreated.Body)
+	}
+}
+
+func TestRecordConfigRevisionRetriesTakenRevision(t *testing.T) {
+	revisionFM := RevisionFM
+	t.Cleanup(func() { RevisionFM = revisionFM })
+	revisions := []bson.M{{"Team": "Ops", "Name": "errors", "Revision": 1}}
+	RevisionFM = memoryFileManager(&revisions)
+	insert := RevisionFM.InsertFunction
+	RevisionFM.InsertFunction = func(document interface{}, config interface{}) error {
+		if document.(ConfigRevision).Revision == 2 && len(revisions) == 1 {
+			// a concurrent change records revision 2 first
+			revisions = append(revisions, bson.M{"Team": "Ops", "Name": "errors", "Revision": 2})
+			return ErrDuplicate
+		}
+		return insert(document, config)
+	}
+	if err := RecordConfigRevision(context.Background(), bson.M{"Team": "Ops", "Name": "errors"}, "Update", "ops-bot"); err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 3 || fmt.Sprint(revisions[2]["Revision"]) != "3" {
+		t.Errorf("expected the revision to be recorded as 3 after the conflict, got %v", revisions)
+	}
+}
+
+func TestApiV2Configs(t *testing.T) {
+	stores := useMemoryStores(t)
+	gin.SetMode(gin.TestMode)
+	router := NewRouter()
+	request := func(method string, path string, body string, headers ...string) *httptest.ResponseRecorder {
+		return requestAs(router, "ops-bot", method, path, body, headers...)
+	}
+
+	created := request("POST", "/api/2/teams/Ops/configs", `{"Name": "errors", "LogSeverity": "Error", "LogLogic": "Count", "NotificationMethod": "Mail", "NotificationRecipient": ["ops@example.com"]}`)
+	config := TeamConfig{}
+	json.Unmarshal(created.Body.Bytes(), &config)
+	if created.Code != 201 || created.Header().Get("Location") != "/api/2/teams/Ops/configs/errors" || config.ID == "" || config.Team != "Ops" {
+		t.Errorf("expected 201 with the created configuration and its location, got %d %s", created.Code, created.Body)
+	}
+	listed := request("GET", "/api/2/teams/Ops/configs?limit=10", "")
+	page := configpage{}
+	json.Unmarshal(listed.Body.Bytes(), &page)
+	if listed.Code != 200 || page.Total != 1 || len(page.Items) != 1 || page.Limit != 10 {
+		t.Errorf("expected a page with the configuration, got %d %s", listed.Code, listed.Body)
+	}
+	if forbidden := request("GET", "/api/2/teams/Payments/configs", ""); forbidden.Code != 403 {
+		t.Errorf("configurations of another team must be forbidden, got %d", forbidden.Code)
+	}
+	renamed := request("PUT", "/api/2/teams/Ops/configs/errors", `{"Name": "failures", "HoldTime": 5}`, "If-Match", `"1"`)
+	json.Unmarshal(renamed.Body.Bytes(), &config)
+	if renamed.Code != 200 || renamed.Header().Get("Location") != "/api/2/teams/Ops/configs/failures" || renamed.Header().Get("ETag") != `"2"` || config.Name != "failures" || config.HoldTime != 5 {
+		t.Errorf("expected the renamed configuration with its new location and ETag, got %d %s", renamed.Code, renamed.Body)
+	}
+	if stale := request("PUT", "/api/2/teams/Ops/configs/failures", `{"HoldTime": 10}`, "If-Match", `"1"`); stale.Code != 412 {
+		t.Errorf("update with a stale If-Match must answer 412, got %d %s", stale.Code, stale.Body)
+	}
+	if missing := request("PUT", "/api/2/teams/Ops/configs/errors", `{"HoldTime": 10}`); missing.Code != 404 {
+		t.Errorf("the previous name must not be found after the rename, got %d", missing.Code)
+	}
+	if absent := request("PUT", "/api/2/teams/Ops/configs/errors", `{"HoldTime": 10}`, "If-Match", "*"); absent.Code != 412 {
+		t.Errorf("If-Match: * on a missing configuration must answer 412, got %d", absent.Code)
+	}
+	if absent := request("DELETE", "/api/2/teams/Ops/configs/errors", "", "If-Match", "*"); absent.Code != 412 {
+		t.Errorf("If-Match: * on a missing configuration must answer 412, got %d", absent.Code)
+	}
+	if existing := request("PUT", "/api/2/teams/Ops/configs/failures", `{"HoldTime": 10}`, "If-Match", "*"); existing.Code != 200 || existing.Header().Get("ETag") != `"3"` {
+		t.Errorf("If-Match: * must update an existing configuration of any revision, got %d %s", existing.Code, existing.Body)
+	}
+	if removed := request("DELETE", "/api/2/teams/Ops/configs/failures", ""); removed.Code != 204 || removed.Body.Len() != 0 {
+		t.Errorf("expected 204 without body, got %d %s", removed.Code, removed.Body)
+	}
+	if missing := request("DELETE", "/api/2/teams/Ops/configs/failures", ""); missing.Code != 404 {
+		t.Errorf("removing a missing configuration must answer 404, got %d", missing.Code)
+	}
+	if len(stores.sent) != 4 || stores.sent[3].(eventmessage).Event["UpdateType"] != "Delete" || stores.sent[3].(eventmessage).Event["ID"] != config.ID {
+		t.Errorf("expected Add, Update and Delete events through the shared publisher, got %v", stores.sent)
+	}
+	legacy := request("GET", "/api/1/config", "")
+	if legacy.Code != 200 || strings.TrimSpace(legacy.Body.String()) != "[]" {
+		t.Errorf("/api/1 must keep answering with a plain list, got %d %s", legacy.Code, legacy.Body)
+	}
+}
+
+func TestApiV2Users(t *testing.T) {
+	stores := useMemoryStores(t)
+	gin.SetMode(gin.TestMode)
+	router := NewRouter()
+
+	if forbidden := requestAs(router, "ops-bot", "POST", "/api/2/users", `{"Name": "qa-bot", "Team": "Ops", "Password": "secret"}`); forbidden.Code != 403 {
+		t.Errorf("only system users may add users, got %d", forbidden.Code)
+	}
+	created := requestAs(router, "admin", "POST", "/api/2/users", `{"Name": "qa-bot", "Team": "Ops", "Password": "secret"}`)
+	user := ApiUser{}
+	json.Unmarshal(created.Body.Bytes(), &user)
+	if created.Code != 201 || created.Header().Get("Location") != "/api/2/users/qa-bot" || user.Name != "qa-bot" || strings.Contains(created.Body.String(), `"Password"`) {
+		t.Errorf("expected 201 with the created user without its password, got %d %s", created.Code, created.Body)
+	}
+	listed := requestAs(router, "ops-bot", "GET", "/api/2/users?limit=1&page=2", "")
+	page := userpage{}
+	json.Unmarshal(listed.Body.Bytes(), &page)
+	if listed.Code != 200 || page.Total != 2 || len(page.Items) != 1 || page.Page != 2 {
+		t.Errorf("expected the second page of the users of Ops, got %d %s", listed.Code, listed.Body)
+	}
+	if got := requestAs(router, "ops-bot", "GET", "/api/2/users/qa-bot", ""); got.Code != 200 {
+		t.Errorf("expected the user, got %d %s", got.Code, got.Body)
+	}
+	if changed := requestAs(router, "qa-bot", "PUT", "/api/2/users/qa-bot", `{"Password": "rotated"}`); changed.Code != 204 || changed.Body.Len() != 0 {
+		t.Errorf("expected 204 for an own password change, got %d %s", changed.Code, changed.Body)
+	}
+	if changed := requestAs(router, "ops-bot", "PUT", "/api/2/users/qa-bot", `{"Password": "stolen"}`); changed.Code != 403 {
+		t.Errorf("changing the password of another user must be forbidden, got %d", changed.Code)
+	}
+	if removed := requestAs(router, "admin", "DELETE", "/api/2/users/qa-bot", ""); removed.Code != 204 || len(stores.users) != 2 {
+		t.Errorf("expected 204 and the user removed, got %d %v", removed.Code, stores.users)
+	}
+	if missing := requestAs(router, "admin", "DELETE", "/api/2/users/qa-bot", ""); missing.Code != 404 {
+		t.Errorf("removing a missing user must answer 404, got %d", missing.Code)
+	}
+}
+
+func TestExpiredPasswordMayOnlyBeChanged(t *testing.T) {
+	stores := useMemoryStores(t)
+	stores.users[0]["PasswordCreated"] = time.Now().Add(-48 * time.Hour).Format(time.RFC3339Nano)
+	GlobalConfig.PasswordPolicy = PasswordPolicy{MaxAge: 24 * time.Hour}
+	gin.SetMode(gin.TestMode)
+	router := NewRouter()
+
+	for _, refused := range []struct{ method, path, body string }{
+		{"GET", "/api/1/config", ""},
+		{"PUT", "/api/1/user", `{"Name": "admin", "Password": "rotated"}`},
+		{"PUT", "/api/1/user", `{"MustChangePassword": false}`},
+		{"PUT", "/api/2/users/admin", `{"Password": "rotated"}`},
+		{"PUT", "/api/2/users/ops-bot", `{"Name": "ops-bot"}`},
+	} {
+		if response := requestAs(router, "ops-bot", refused.method, refused.path, refused.body); response.Code != 403 {
+			t.Errorf("%s %s %s with an expired password must answer 403, got %d", refused.method, refused.path, refused.body, response.Code)
+		}
+	}
+	if changed := requestAs(router, "ops-bot", "PUT", "/api/1/user", `{"Name": "ops-bot", "Password": "rotated"}`); changed.Code != 200 {
+		t.Errorf("an expired password must be changeable by its owner, got %d %s", changed.Code, changed.Body)
+	}
+	stores.users[0]["Password"], stores.users[0]["PasswordCreated"] = GetHash("secret"), time.Now().Add(-48*time.Hour).Format(time.RFC3339Nano)
+	if changed := requestAs(router, "ops-bot", "PUT", "/api/2/users/ops-bot", `{"Password": "secret2"}`); changed.Code != 204 {
+		t.Errorf("an expired password must be changeable through /api/2, got %d %s", changed.Code, changed.Body)
+	}
+}
+
+func TestOwnPasswordChangeMayClearOnlyItsOwnFlag(t *testing.T) {
+	stores := useMemoryStores(t)
+	stores.users[0]["MustChangePassword"] = true
+	gin.SetMode(gin.TestMode)
+	router := NewRouter()
+
+	if forced := requestAs(router, "ops-bot", "PUT", "/api/1/user", `{"Name": "ops-bot", "Password": "rotated", "MustChangePassword": true}`); forced.Code != 403 {
+		t.Errorf("only system users may force a password change, got %d", forced.Code)
+	}
+	if cleared := requestAs(router, "ops-bot", "PUT", "/api/2/users/ops-bot", `{"MustChangePassword": false}`); cleared.Code != 403 || stores.users[0]["MustChangePassword"] != true {
+		t.Errorf("a pending change must not be cleared without a new password, got %d %v", cleared.Code, stores.users[0])
+	}
+	if changed := requestAs(router, "ops-bot", "PUT", "/api/1/user", `{"Name": "ops-bot", "Password": "rotated", "MustChangePassword": false}`); changed.Code != 200 || stores.users[0]["MustChangePassword"] != false {
+		t.Errorf("an own password change with MustChangePassword false must be accepted, got %d %s", changed.Code, changed.Body)
+	}
+}
+
+func TestBreakerState(t *testing.T) {
+	breaker := GetBreakerOverloadInstance(func(message interface{}) error { return fmt.Errorf("connection refused") })
+	var wait sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wait.Add(2)
+		go func() {
+			defer wait.Done()
+			breaker.Do(bson.M{})
+		}()
+		go func() {
+			defer wait.Done()
+			breaker.State()
+		}()
+	}
+	wait.Wait()
+	if status, failures := breaker.State(); status != "Open" || failures < breaker.FailThreshold {
+		t.Errorf("expected an open breaker after %d failures, got %s after %d", breaker.FailThreshold, status, failures)
+	}
+	breaker.Stop()
+	if status, _ := breaker.State(); status != "Stopped" {
+		t.Errorf("expected a stopped breaker, got %s", status)
+	}
+	var missing *Breaker
+	if status, failures := missing.State(); status != "" || failures != 0 {
+		t.Errorf("a breaker which is not created must report nothing, got %s %d", status, failures)
+	}
+}
+
+func TestUpdateConfigErrorMessages(t *testing.T) {
+	stores := useMemoryStores(t)
+	stores.configs = append(stores.configs, bson.M{"ID": "abc", "Team": "Ops", "Name": "errors", "HoldTime": 5.0, "Revision": 1.0})
+	ConfigFM.UpdateAndGetFunction = func(filter interface{}, update interface{}, config interface{}) ([]byte, error) {
+		return nil, fmt.Errorf("%w: write conflict", ErrConflict)
+	}
+	gin.SetMode(gin.TestMode)
+	router := NewRouter()
+
+	response := requestAs(router, "ops-bot", "PUT", "/api/2/teams/Ops/configs/errors", `{"HoldTime": 10}`)
+	if response.Code != 409 || strings.Contains(response.Body.String(), "no configuration found") {
+		t.Errorf("a failed update of an existing configuration must not claim it is missing, got %d %s", response.Code, response.Body)
+	}
+	if missing := requestAs(router, "ops-bot", "PUT", "/api/2/teams/Ops/configs/warnings", `{"HoldTime": 10}`); missing.Code != 404 || !strings.Contains(missing.Body.String(), "no configuration found") {
+		t.Errorf("expected 404 for a missing configuration, got %d %s", missing.Code, missing.Body)
+	}
+}
+
+func TestTransactionUnsupported(t *testing.T) {
+	standalone := mongo.CommandError{Code: 20, Name: "IllegalOperation", Message: "Transaction numbers are only allowed on a replica set member or mongos"}
+	if !isTransactionUnsupported(fmt.Errorf("commit: %w", standalone)) {
+		t.Error("the error of a standalone server must be recognized")
+	}
+	if isTransactionUnsupported(mongo.CommandError{Code: 112, Name: "WriteConflict", Message: "write conflict"}) {
+		t.Error("other command errors must not be reported as missing transaction support")
+	}
+}
+
+func TestConfigApplyFromStandardInputNeedsYes(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"Applied": false, "PlanID": "plan", "Plan": []}`))
+	}))
+	defer server.Close()
+	t.Setenv("LOG2N_PROFILES", filepath.Join(t.TempDir(), "profiles.yaml"))
+	t.Setenv("LOG2N_URL", server.URL)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	stdin := strings.NewReader(`{"Configs": []}`)
+	if code := RunCommand([]string{"config", "apply", "-f", "-"}, stdin, stdout, stderr); code != exitUsage || requests != 0 {
+		t.Errorf("expected a usage error before any request, got %d after %d requests: %s", code, requests, stderr)
+	}
+	if !strings.Contains(stderr.String(), "--yes") {
+		t.Errorf("the error must name --yes: %s", stderr)
+	}
+}
+
+func TestDeleteConfigReportsUnavailableStorage(t *testing.T) {
+	stores := useMemoryStores(t)
+	gin.SetMode(gin.TestMode)
+	router := NewRouter()
+	requestAs(router, "ops-bot", "POST", "/api/2/teams/Ops/configs", `{"Name": "errors", "LogSeverity": "Error", "LogLogic": "Count", "NotificationMethod": "Mail", "NotificationRecipient": ["ops@example.com"]}`)
+	ConfigFM.GetFunction = func(filter interface{}, config interface{}) ([]byte, error) {
+		return nil, fmt.Errorf("%w: server selection timeout", ErrUnavailable)
+	}
+	if removed := requestAs(router, "ops-bot", "DELETE", "/api/2/teams/Ops/configs/errors", ""); removed.Code != 503 {
+		t.Errorf("Have to answer 503 when the configuration cannot be read instead of %d", removed.Code)
+	}
+	if len(stores.configs) != 1 {
+		t.Errorf("Have to keep the configuration when it cannot be read: %v", stores.configs)
+	}
+}
+
+func TestSyncAppliesOnlyThePlanAndPublishesEveryChange(t *testing.T) {
+	stores := useMemoryStores(t)
+	gin.SetMode(gin.TestMode)
+	router := NewRouter()
+	stores.configs = []bson.M{
+		{"Name": "debug", "Team": "Ops", "LogSeverity": "Debug", "LogLogic": "Count", "NotificationMethod": "Mail", "NotificationRecipient": []string{"ops@example.com"}, "Revision": 1},
+		{"Name": "errors", "Team": "Ops", "LogSeverity": "Error", "LogLogic": "Count", "NotificationMethod": "Mail", "NotificationRecipient": []string{"ops@example.com"}, "Revision": 1},
+	}
+	bundle := `{"Configs": [
+		{"Name": "errors", "LogSeverity": "Error", "LogLogic": "Count", "NotificationMethod": "Mail", "NotificationRecipient": ["ops@example.com"], "HoldTime": 10},
+		{"Name": "warnings", "LogSeverity": "Warning", "LogLogic": "Count", "NotificationMethod": "Mail", "NotificationRecipient": ["ops@example.com"]}
+	]}`
+	result := syncresult{}
+	json.Unmarshal(requestAs(router, "ops-bot", "POST", "/api/1/config/sync", bundle).Body.Bytes(), &result)
+	ConfigFM.ApplyFunction = func(operations []DocOperation, config interface{}) error {
+		return ErrNotFound
+	}
+	if changed := requestAs(router, "ops-bot", "POST", "/api/1/config/sync?planId="+result.PlanID, bundle); changed.Code != 412 {
+		t.Errorf("Have to answer 412 when a planned configuration changed during the apply instead of %d", changed.Code)
+	}
+	ConfigFM.ApplyFunction = func(operations []DocOperation, config interface{}) error {
+		return nil
+	}
+	published := []string{}
+	CM = GetBreakerOverloadInstance(func(message interface{}) error {
+		name := fmt.Sprint(message.(eventmessage).Event["Name"])
+		if name == "debug" {
+			return fmt.Errorf("channel closed")
+		}
+		published = append(published, name)
+		return nil
+	})
+	applied := requestAs(router, "ops-bot", "POST", "/api/1/config/sync?planId="+result.PlanID, bundle)
+	if applied.Code != 503 || !strings.Contains(applied.Body.String(), "changes of debug were not published") {
+		t.Errorf("Have to name the configurations whose changes were not published: %d %s", applied.Code, applied.Body)
+	}
+	if strings.Join(published, ",") != "errors,warnings" {
+		t.Errorf("Have to publish the other changes after a failed one instead of %v", published)
+	}
+}
+
+func TestRemoveTeamPublishesEveryChange(t *testing.T) {
+	stores := useMemoryStores(t)
+	gin.SetMode(gin.TestMode)
+	router := NewRouter()
+	stores.configs = []bson.M{{"Name": "debug", "Team": "Ops", "Revision": 1}, {"Name": "errors", "Team": "Ops", "Revision": 2}}
+	stores.revisions = []bson.M{{"Name": "errors", "Team": "Ops", "Revision": 1}, {"Name": "errors", "Team": "Ops", "Revision": 2}}
+	published := []string{}
+	CM = GetBreakerOverloadInstance(func(message interface{}) error {
+		name := fmt.Sprint(message.(eventmessage).Event["Name"])
+		if name == "debug" {
+			return fmt.Errorf("channel closed")
+		}
+		published = append(published, name)
+		return nil
+	})
+	removed := requestAs(router, "admin", "DELETE", "/api/1/team", `{"Name": "Ops", "Cascade": true}`)
+	if removed.Code != 503 || !strings.Contains(removed.Body.String(), "changes of debug were not published") {
+		t.Errorf("Have to name the configurations whose changes were not published: %d %s", removed.Code, removed.Body)
+	}
+	if strings.Join(published, ",") != "errors" {
+		t.Errorf("Have to publish the other changes after a failed one instead of %v", published)
+	}
+	if len(stores.configs) != 0 || len(stores.revisions) != 0 {
+		t.Errorf("Have to remove the configurations and revisions of the team: %v %v", stores.configs, stores.revisions)
+	}
+}
@@ -5,19 +5,39 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
 )
 
+// StorageError converts driver errors to the sentinel errors which handlers map to responses
+func StorageError(err error) error {
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrDuplicate) || errors.Is(err, ErrNoChange) || errors.Is(err, ErrUnavailable) {
+		return err
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("%w: %s", ErrDuplicate, err)
+	}
+	var selectionErr topology.ServerSelectionError
+	if mongo.IsTimeout(err) || mongo.IsNetworkError(err) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &selectionErr) {
+		return fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+	return err
+}
+
 func GetDoc(filter interface{}, config interface{}) ([]byte, error) {
 	dbconfig, ok := config.(commonconfig)
 	if !ok {
 		return nil, fmt.Errorf("config argument is not type of webconfig")
 	}
-	client, err := mongo.NewClient(options.Client().ApplyURI(dbconfig.Connectionstring))
+	client, err := mongo.NewClient(options.Client().ApplyURI(dbconfig.ConnectionURI()))
 	if err != nil {
 		return nil, err
 	}
@@ -48,12 +68,61 @@ func GetDoc(filter interface{}, config interface{}) ([]byte, error) {
 	return bytes, nil
 }
 
+func GetDocPage(filter interface{}, findOptions FindOptions, config interface{}) ([]byte, int64, error) {
+	dbconfig, ok := config.(commonconfig)
+	if !ok {
+		return nil, 0, fmt.Errorf("config argument is not type of webconfig")
+	}
+	client, err := mongo.NewClient(options.Client().ApplyURI(dbconfig.ConnectionURI()))
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	err = client.Connect(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer client.Disconnect(ctx)
+	Database := client.Database(dbconfig.Database)
+	Collection := Database.Collection(dbconfig.Collection)
+	total, err := Collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	myOptions := options.Find().SetSkip(findOptions.Skip)
+	if findOptions.Limit > 0 {
+		myOptions.SetLimit(findOptions.Limit)
+	}
+	if findOptions.Sort != nil {
+		myOptions.SetSort(findOptions.Sort)
+	}
+	if findOptions.Projection != nil {
+		myOptions.SetProjection(findOptions.Projection)
+	}
+	docs, err := Collection.Find(ctx, filter, myOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer docs.Close(ctx)
+	result := []bson.M{}
+	err = docs.All(ctx, &result)
+	if err != nil {
+		return nil, 0, err
+	}
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes, total, nil
+}
+
 func SetDoc(filter interface{}, update interface{}, config interface{}) error {
 	dbconfig, ok := config.(commonconfig)
 	if !ok {
 		return fmt.Errorf("config argument is not type of webconfig")
 	}
-	client, err := mongo.NewClient(options.Client().ApplyURI(dbconfig.Connectionstring))
+	client, err := mongo.NewClient(options.Client().ApplyURI(dbconfig.ConnectionURI()))
 	if err != nil {
 		return err
 	}
@@ -75,7 +144,35 @@ func SetDoc(filter interface{}, update interface{}, config interface{}) error {
 		return err
 	}
 	if updateeResult.MatchedCount == 0 {
-		return fmt.Errorf("no document to update")
+		return ErrNotFound
+	}
+	if updateeResult.ModifiedCount == 0 {
+		return ErrNoChange
+	}
+	return nil
+}
+
+func SetDocs(filter interface{}, update interface{}, config interface{}) error {
+	dbconfig, ok := config.(commonconfig)
+	if !ok {
+		return fmt.Errorf("config argument is not type of webconfig")
+	}
+	client, err := mongo.NewClient(options.Client().ApplyURI(dbconfig.ConnectionURI()))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	err = client.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+	Database := client.Database(dbconfig.Database)
+	Collection := Database.Collection(dbconfig.Collection)
+	_, err = Collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return err
 	}
 	return nil
 }
@@ -86,7 +183,7 @@ func SetGetDoc(filter interface{}, update interface{}, config interface{}) ([]by
 		return nil, fmt.Errorf("config argument is not type of webconfig")
 	}
 	result := bson.M{}
-	client, err := mongo.NewClient(options.Client().ApplyURI(dbconfig.Connectionstring))
+	client, err := mongo.NewClient(options.Client().ApplyURI(dbconfig.ConnectionURI()))
 	if err != nil {
 		return nil, err
 	}
@@ -127,7 +224,7 @@ func AddDoc(document interface{}, config interface{}) error {
 	if !ok {
 		return fmt.Errorf("config argument is not type of webconfig")
 	}
-	client, err := mongo.NewClient(options.Client().ApplyURI(dbconfig.Connectionstring))
+	client, err := mongo.NewClient(options.Client().ApplyURI(dbconfig.ConnectionURI()))
 	if err != nil {
 		return err
 	}
@@ -152,7 +249,7 @@ func RemoveDoc(filter interface{}, config interface{}) error {
 	if !ok {
 		return fmt.Errorf("config argument is not type of webconfig")
 	}
-	client, err := mongo.NewClient(options.Client().ApplyURI(dbconfig.Connectionstring))
+	client, err := mongo.NewClient(options.Client().ApplyURI(dbconfig.ConnectionURI()))
 	if err != nil {
 		return err
 	}
@@ -170,25 +267,205 @@ func RemoveDoc(filter interface{}, config interface{}) error {
 		return err
 	}
 	if delResult.DeletedCount == 0 {
-		return errors.New("nothing to delete")
+		return ErrNotFound
+	}
+	return nil
+}
+
+func RemoveDocs(filter interface{}, config interface{}) error {
+	dbconfig, ok := config.(commonconfig)
+	if !ok {
+		return fmt.Errorf("config argument is not type of webconfig")
+	}
+	client, err := mongo.NewClient(options.Client().ApplyURI(dbconfig.ConnectionURI()))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	err = client.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+	Database := client.Database(dbconfig.Database)
+	Collection := Database.Collection(dbconfig.Collection)
+	_, err = Collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return err
 	}
 	return nil
 }
 
+// ErrTransactionsUnsupported is returned by ApplyDocs when MongoDB runs as a standalone server
+var ErrTransactionsUnsupported = errors.New("MongoDB must run as a replica set or a sharded cluster to apply changes in a transaction")
+
+// isTransactionUnsupported tells the error a standalone server returns for the first operation of a transaction
+func isTransactionUnsupported(err error) bool {
+	var commandErr mongo.CommandError
+	return errors.As(err, &commandErr) && strings.Contains(commandErr.Message, "Transaction numbers are only allowed on a replica set")
+}
+
+// ApplyDocs runs all operations in a single transaction so either all of them or none are stored.
+// Transactions need MongoDB to run as a replica set or a sharded cluster, a single node replica set is enough
+func ApplyDocs(operations []DocOperation, config interface{}) error {
+	dbconfig, ok := config.(commonconfig)
+	if !ok {
+		return fmt.Errorf("config argument is not type of webconfig")
+	}
+	client, err := mongo.NewClient(options.Client().ApplyURI(dbconfig.ConnectionURI()))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = client.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+	Database := client.Database(dbconfig.Database)
+	Collection := Database.Collection(dbconfig.Collection)
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		for _, operation := range operations {
+			switch operation.Action {
+			case "Insert":
+				if _, err := Collection.InsertOne(sessCtx, operation.Document); err != nil {
+					return nil, err
+				}
+			case "Update":
+				updateResult, err := Collection.UpdateOne(sessCtx, operation.Filter, operation.Document)
+				if err != nil {
+					return nil, err
+				}
+				if updateResult.MatchedCount == 0 {
+					return nil, ErrNotFound
+				}
+			case "Delete":
+				delResult, err := Collection.DeleteOne(sessCtx, operation.Filter)
+				if err != nil {
+					return nil, err
+				}
+				if delResult.DeletedCount == 0 {
+					return nil, ErrNotFound
+				}
+			default:
+				return nil, fmt.Errorf("unknown operation: %s", operation.Action)
+			}
+		}
+		return nil, nil
+	})
+	if isTransactionUnsupported(err) {
+		return fmt.Errorf("%w: %s", ErrTransactionsUnsupported, err)
+	}
+	return err
+}
+
+func AddIndex(keys interface{}, unique bool, config interface{}) error {
+	dbconfig, ok := config.(commonconfig)
+	if !ok {
+		return fmt.Errorf("config argument is not type of webconfig")
+	}
+	client, err := mongo.NewClient(options.Client().ApplyURI(dbconfig.ConnectionURI()))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err = client.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+	Database := client.Database(dbconfig.Database)
+	Collection := Database.Collection(dbconfig.Collection)
+	index := mongo.IndexModel{Keys: keys, Options: options.Index().SetUnique(unique)}
+	_, err = Collection.Indexes().CreateOne(ctx, index)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RemoveIndex drops the index created with the given keys, a missing index is not an error
+func RemoveIndex(keys interface{}, config interface{}) error {
+	dbconfig, ok := config.(commonconfig)
+	if !ok {
+		return fmt.Errorf("config argument is not type of webconfig")
+	}
+	indexKeys, ok := keys.(bson.D)
+	if !ok {
+		return fmt.Errorf("keys argument is not type of bson.D")
+	}
+	names := []string{}
+	for _, key := range indexKeys {
+		names = append(names, fmt.Sprintf("%s_%v", key.Key, key.Value))
+	}
+	client, err := mongo.NewClient(options.Client().ApplyURI(dbconfig.ConnectionURI()))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err = client.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+	Database := client.Database(dbconfig.Database)
+	Collection := Database.Collection(dbconfig.Collection)
+	_, err = Collection.Indexes().DropOne(ctx, strings.Join(names, "_"))
+	if commandErr, ok := err.(mongo.CommandError); ok && (commandErr.Code == 27 || commandErr.Code == 26) {
+		// 27 is IndexNotFound and 26 is NamespaceNotFound
+		return nil
+	}
+	return err
+}
+
+type DocOperation struct {
+	Action   string // Insert, Update or Delete
+	Filter   interface{}
+	Document interface{}
+}
+
+type FindOptions struct {
+	Skip       int64
+	Limit      int64
+	Sort       bson.D
+	Projection bson.M
+}
+
 type DBConfig struct {
 	Database         string
 	Collection       string
 	Connectionstring string
+	ConnectionSecret string // name of the secret holding the connection string, it takes precedence once rotated
+}
+
+// ConnectionURI returns the current connection string, every client is created per operation so rotated credentials apply to the next one
+func (d DBConfig) ConnectionURI() string {
+	if value, ok := Secrets.Value(d.ConnectionSecret); ok && d.ConnectionSecret != "" {
+		return value
+	}
+	return d.Connectionstring
 }
 
 type Account struct {
-	Team     string `bson:"Team" json:"Team"`
-	Name     string `bson:"Name" json:"Name"`
-	Password string `bson:"Password" json:"Password"`
+	Team               string    `bson:"Team" json:"Team"`
+	Name               string    `bson:"Name" json:"Name"`
+	Password           string    `bson:"Password" json:"Password"`
+	PasswordCreated    time.Time `bson:"PasswordCreated" json:"PasswordCreated"`
+	PasswordHistory    []string  `bson:"PasswordHistory" json:"PasswordHistory"`
+	MustChangePassword bool      `bson:"MustChangePassword" json:"MustChangePassword"`
 }
 
 func ValidateDBConfig(conf DBConfig) error {
-	client, err := mongo.NewClient(options.Client().ApplyURI(conf.Connectionstring))
+	client, err := mongo.NewClient(options.Client().ApplyURI(conf.ConnectionURI()))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Sentinel errors returned by the storage layer and handlers, RespondError maps them to HTTP statuses
+var (
+	ErrInvalid              = errors.New("invalid request")
+	ErrUnauthorized         = errors.New("not authenticated")
+	ErrForbidden            = errors.New("not authorized")
+	ErrNotFound             = errors.New("not found")
+	ErrDuplicate            = errors.New("already exists")
+	ErrNoChange             = errors.New("no change")
+	ErrConflict             = errors.New("conflict")
+	ErrPreconditionFailed   = errors.New("precondition failed")
+	ErrPreconditionRequired = errors.New("precondition required")
+	ErrUnavailable          = errors.New("dependency unavailable")
+)
+
+const requestIDHeader = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestID keeps the request ID given by the client or creates one, and returns it in the response header
+func RequestID(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !requestIDPattern.MatchString(id) {
+		id = primitive.NewObjectID().Hex()
+	}
+	c.Set("RequestID", id)
+	c.Header(requestIDHeader, id)
+	c.Next()
+}
+
+func GetRequestID(c *gin.Context) string {
+	return c.GetString("RequestID")
+}
+
+// ErrorStatus returns the HTTP status and the machine readable code of an error
+func ErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrInvalid):
+		return 400, "invalid_request"
+	case errors.Is(err, ErrUnauthorized):
+		return 401, "unauthorized"
+	case errors.Is(err, ErrForbidden):
+		return 403, "forbidden"
+	case errors.Is(err, ErrNotFound):
+		return 404, "not_found"
+	case errors.Is(err, ErrDuplicate):
+		return 409, "duplicate"
+	case errors.Is(err, ErrNoChange):
+		return 409, "no_change"
+	case errors.Is(err, ErrConflict):
+		return 409, "conflict"
+	case errors.Is(err, ErrPreconditionFailed):
+		return 412, "precondition_failed"
+	case errors.Is(err, ErrPreconditionRequired):
+		return 428, "precondition_required"
+	case errors.Is(err, ErrUnavailable):
+		return 503, "unavailable"
+	}
+	return 500, "internal_error"
+}
+
+// Invalid marks a validation error so it is answered with 400
+func Invalid(err error) error {
+	if err == nil || errors.Is(err, ErrInvalid) {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrInvalid, err)
+}
+
+// RespondError aborts the request with the status of err. The message is shown to clients, except for
+// unexpected and dependency errors which are answered with a generic message.
+func RespondError(c *gin.Context, err error, message string) {
+	status, _ := ErrorStatus(err)
+	if status == 503 {
+		message = "Service is temporarily unavailable. Please retry later"
+	} else if status >= 500 {
+		message = "Unhandled exception. Please contact to Administrator"
+	} else if message == "" {
+		message = fmt.Sprint(err)
+	}
+	RespondOutcome(c, err, message)
+}
+
+// RespondOutcome aborts the request with the status of err and always shows the message,
+// it is used when the client must know what was stored before the failure
+func RespondOutcome(c *gin.Context, err error, message string) {
+	status, code := ErrorStatus(err)
+	if status >= 500 {
+		RequestLogger(c).Error("request failed", "status", status, "error", err)
+	}
+	c.IndentedJSON(status, httpresponse{Status: false, Message: message, Code: code, RequestID: GetRequestID(c)})
+	c.Abort()
+}
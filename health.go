@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type dependencycheck struct {
+	Name  string
+	Check func() error
+}
+
+type dependencystatus struct {
+	Status string
+	Error  string `json:",omitempty"`
+}
+
+type readiness struct {
+	Ready        bool
+	Dependencies map[string]dependencystatus
+}
+
+// readinessCacheTTL bounds how often probes reach the database and the broker, every check dials a new connection
+const readinessCacheTTL = 5 * time.Second
+
+type cachedresult struct {
+	mutex   sync.Mutex
+	checked time.Time
+	err     error
+}
+
+var readinessCache sync.Map
+
+// cachedCheck reuses the result of check for readinessCacheTTL, concurrent probes wait for the running check instead of dialing again
+func cachedCheck(name string, check func() error) func() error {
+	return func() error {
+		value, _ := readinessCache.LoadOrStore(name, &cachedresult{})
+		cached := value.(*cachedresult)
+		cached.mutex.Lock()
+		defer cached.mutex.Unlock()
+		if time.Since(cached.checked) >= readinessCacheTTL {
+			cached.err = check()
+			cached.checked = time.Now()
+		}
+		return cached.err
+	}
+}
+
+// ReadinessChecks returns the dependencies which must be reachable to serve requests
+func ReadinessChecks() []dependencycheck {
+	checks := []dependencycheck{}
+	for _, conf := range GlobalConfig.DBConf {
+		conf := conf
+		name := fmt.Sprintf("mongodb:%s.%s", conf.Database, conf.Collection)
+		checks = append(checks, dependencycheck{
+			Name:  name,
+			Check: cachedCheck(name, func() error { return ValidateDBConfig(conf) }),
+		})
+	}
+	checks = append(checks,
+		dependencycheck{
+			Name:  "rabbitmq:" + GlobalConfig.QName,
+			Check: cachedCheck("rabbitmq:"+GlobalConfig.QName, func() error { return CheckQueue(getCommonConfig(GlobalConfig.DBConf[0])) }),
+		},
+		dependencycheck{
+			Name: "shutdown",
+			Check: func() error {
+				if draining.Load() {
+					return fmt.Errorf("service is shutting down")
+				}
+				return nil
+			},
+		},
+		dependencycheck{
+			Name: "breaker",
+			Check: func() error {
+				if status, failures := CM.State(); status == "Open" {
+					return fmt.Errorf("event publishing is suspended after %d failures", failures)
+				}
+				return nil
+			},
+		},
+	)
+	return checks
+}
+
+// GetReadiness runs all checks concurrently, the service is ready only when every check passes
+func GetReadiness(checks []dependencycheck) readiness {
+	result := readiness{Ready: true, Dependencies: map[string]dependencystatus{}}
+	var mutex sync.Mutex
+	var wait sync.WaitGroup
+	for _, check := range checks {
+		wait.Add(1)
+		go func(check dependencycheck) {
+			defer wait.Done()
+			status := dependencystatus{Status: "up"}
+			if err := check.Check(); err != nil {
+				status = dependencystatus{Status: "down", Error: fmt.Sprint(err)}
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			result.Dependencies[check.Name] = status
+			if status.Status != "up" {
+				result.Ready = false
+			}
+		}(check)
+	}
+	wait.Wait()
+	return result
+}
+
+// Healthz only tells that the process serves requests, dependencies are checked by Readyz
+func Healthz(c *gin.Context) {
+	c.IndentedJSON(200, gin.H{"Status": "up"})
+}
+
+func Readyz(c *gin.Context) {
+	result := GetReadiness(ReadinessChecks())
+	if !result.Ready {
+		c.IndentedJSON(503, result)
+		return
+	}
+	c.IndentedJSON(200, result)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Logger writes JSON records, main replaces it with one using the configured level
+var Logger = NewLogger(os.Stderr, slog.LevelInfo)
+
+// redactedFields are never written to logs or audit entries
+var redactedFields = map[string]bool{
+	"Password":          true,
+	"PasswordHistory":   true,
+	"Authorization":     true,
+	"Connectionstring":  true,
+	"QConnectionString": true,
+}
+
+func NewLogger(out io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if redactedFields[attr.Key] {
+				return slog.String(attr.Key, "[REDACTED]")
+			}
+			if document, ok := attr.Value.Any().(bson.M); ok {
+				return slog.Any(attr.Key, RedactDocument(document))
+			}
+			return attr
+		},
+	}))
+}
+
+func ParseLogLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.ToUpper(value))); err != nil {
+		return level, fmt.Errorf("log level must be one of debug, info, warn or error")
+	}
+	return level, nil
+}
+
+// RedactDocument returns a copy of the document without sensitive field values, nested documents included
+func RedactDocument(document bson.M) bson.M {
+	redacted := bson.M{}
+	for key, value := range document {
+		switch {
+		case redactedFields[key]:
+			redacted[key] = "[REDACTED]"
+		default:
+			if nested, ok := value.(bson.M); ok {
+				value = RedactDocument(nested)
+			}
+			redacted[key] = value
+		}
+	}
+	return redacted
+}
+
+// RequestLogger adds the request ID, the authenticated user and the route to every record
+func RequestLogger(c *gin.Context) *slog.Logger {
+	return Logger.With("request_id", GetRequestID(c), "user", GetUserName(c), "method", c.Request.Method, "path", c.Request.URL.Path)
+}
+
+// AccessLog writes one record per request, server errors are logged as errors and client errors as warnings
+func AccessLog(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	status := c.Writer.Status()
+	level := slog.LevelInfo
+	if status >= 500 {
+		level = slog.LevelError
+	} else if status >= 400 {
+		level = slog.LevelWarn
+	}
+	RequestLogger(c).Log(c.Request.Context(), level, "request", "status", status, "duration", time.Since(start), "client_ip", c.ClientIP())
+}
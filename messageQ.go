@@ -2,13 +2,22 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"time"
 
 	"github.com/streadway/amqp"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
+// eventmessage is a change event with the headers, such as the trace context, it is published with
+type eventmessage struct {
+	Event   bson.M
+	Headers map[string]string
+}
+
 func SendMessage(message interface{}, configParams interface{}) error {
 	confParams := configParams.(commonconfig)
-	connectRabbitMQ, err := amqp.Dial(confParams.QConnectionString)
+	connectRabbitMQ, err := amqp.Dial(confParams.QURI())
 	if err != nil {
 		return err
 	}
@@ -18,18 +27,54 @@ func SendMessage(message interface{}, configParams interface{}) error {
 		return err
 	}
 	defer channelRabbitMQ.Close()
-	bytes, err := json.Marshal(message)
-	if err != nil {
-		return err
-	}
 	mess := amqp.Publishing{
 		ContentType:  "application/json",
-		Body:         bytes,
 		DeliveryMode: 2,
 	}
+	if event, ok := message.(eventmessage); ok {
+		message = event.Event
+		mess.CorrelationId, _ = event.Event["RequestID"].(string)
+		mess.Headers = amqp.Table{}
+		for key, value := range event.Headers {
+			mess.Headers[key] = value
+		}
+	}
+	mess.Body, err = json.Marshal(message)
+	if err != nil {
+		return err
+	}
 	err = channelRabbitMQ.Publish("", confParams.QName, false, false, mess)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// queueCheckTimeout bounds the dial and handshake of CheckQueue, so that an unreachable broker fails the readiness probe in time
+const queueCheckTimeout = 2 * time.Second
+
+func CheckQueue(configParams interface{}) error {
+	confParams, ok := configParams.(commonconfig)
+	if !ok {
+		return fmt.Errorf("config argument is not type of webconfig")
+	}
+	connectRabbitMQ, err := amqp.DialConfig(confParams.QURI(), amqp.Config{
+		Heartbeat: 10 * time.Second,
+		Locale:    "en_US",
+		Dial:      amqp.DefaultDial(queueCheckTimeout),
+	})
+	if err != nil {
+		return err
+	}
+	defer connectRabbitMQ.Close()
+	channelRabbitMQ, err := connectRabbitMQ.Channel()
+	if err != nil {
+		return err
+	}
+	defer channelRabbitMQ.Close()
+	_, err = channelRabbitMQ.QueueInspect(confParams.QName)
+	if err != nil {
+		return err
+	}
+	return nil
+}
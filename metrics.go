@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "log2n_config_http_requests_total",
+		Help: "HTTP requests by method, route and status.",
+	}, []string{"method", "route", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "log2n_config_http_request_duration_seconds",
+		Help:    "HTTP request latency by method, route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+	storageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "log2n_config_storage_operation_duration_seconds",
+		Help:    "Storage operation latency by store, operation and outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"store", "operation", "outcome"})
+	eventPublishes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "log2n_config_event_publish_total",
+		Help: "Configuration change events by update type and outcome.",
+	}, []string{"type", "outcome"})
+	authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "log2n_config_auth_failures_total",
+		Help: "Rejected authentications by reason.",
+	}, []string{"reason"})
+	revisionFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "log2n_config_revision_failures_total",
+		Help: "Stored changes whose configuration revision could not be recorded, by action.",
+	}, []string{"action"})
+	breakerStates = []string{"Closed", "HalfOpen", "Open", "Stopped"}
+)
+
+func init() {
+	for _, state := range breakerStates {
+		state := state
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "log2n_config_breaker_state",
+			Help:        "1 for the current state of the event publishing circuit breaker.",
+			ConstLabels: prometheus.Labels{"state": state},
+		}, func() float64 {
+			if status, _ := CM.State(); status == state {
+				return 1
+			}
+			return 0
+		})
+	}
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "log2n_config_breaker_failures",
+		Help: "Failed publishes counted by the circuit breaker since it was last closed.",
+	}, func() float64 {
+		_, failures := CM.State()
+		return float64(failures)
+	})
+}
+
+// Metrics records the count and latency of requests by their route template, unmatched paths share one label
+func Metrics(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	status := strconv.Itoa(c.Writer.Status())
+	httpRequests.WithLabelValues(c.Request.Method, route, status).Inc()
+	httpDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+}
+
+func ObserveStorage(store string, operation string, start time.Time, err error) {
+	storageDuration.WithLabelValues(store, operation, storageOutcome(err)).Observe(time.Since(start).Seconds())
+}
+
+// storageOutcome tells expected results such as a missing document apart from failed operations
+func storageOutcome(err error) string {
+	if err == nil {
+		return "success"
+	}
+	err = StorageError(err)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, ErrNoChange):
+		return "no_change"
+	case errors.Is(err, ErrDuplicate):
+		return "duplicate"
+	}
+	return "error"
+}
+
+func ObservePublish(updateType string, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	eventPublishes.WithLabelValues(updateType, outcome).Inc()
+}
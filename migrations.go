@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var MigrationFM FileManager
+
+// Migration changes indexes or stored documents once. Migrations must be idempotent,
+// because replicas starting at the same time may run the same migration concurrently.
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func() error
+}
+
+type MigrationRecord struct {
+	Version     int       `bson:"Version" json:"Version"`
+	Description string    `bson:"Description" json:"Description"`
+	Applied     time.Time `bson:"Applied" json:"Applied"`
+}
+
+type indexspec struct {
+	Collection string
+	FM         *FileManager
+	Keys       bson.D
+	Unique     bool
+}
+
+// Migrations are applied in the order of their versions. Never change an applied migration, add a new one instead.
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create indexes required by the handlers",
+		Apply: func() error {
+			return ensureIndexes([]indexspec{
+				{Collection: "migration", FM: &MigrationFM, Keys: bson.D{{Key: "Version", Value: 1}}, Unique: true},
+				{Collection: "config", FM: &ConfigFM, Keys: bson.D{{Key: "Name", Value: 1}}, Unique: true},
+				{Collection: "config", FM: &ConfigFM, Keys: bson.D{{Key: "Team", Value: 1}}},
+				{Collection: "user", FM: &UserFM, Keys: bson.D{{Key: "Name", Value: 1}}, Unique: true},
+				{Collection: "user", FM: &UserFM, Keys: bson.D{{Key: "Team", Value: 1}}},
+				{Collection: "team", FM: &TeamFM, Keys: bson.D{{Key: "Name", Value: 1}}, Unique: true},
+				{Collection: "revision", FM: &RevisionFM, Keys: bson.D{{Key: "Team", Value: 1}, {Key: "Name", Value: 1}, {Key: "Revision", Value: 1}}, Unique: true},
+				{Collection: "audit", FM: &AuditFM, Keys: bson.D{{Key: "Time", Value: -1}}},
+			})
+		},
+	},
+	{
+		Version:     2,
+		Description: "add revision counter to configurations created before it existed",
+		Apply: func() error {
+			filter := bson.M{"Revision": bson.M{"$exists": false}}
+			return ConfigFM.UpdateMany(filter, bson.D{{Key: "$set", Value: bson.M{"Revision": 1}}})
+		},
+	},
+	{
+		Version:     3,
+		Description: "add password history and forced change flag to accounts created before they existed",
+		Apply: func() error {
+			err := UserFM.UpdateMany(bson.M{"PasswordHistory": bson.M{"$exists": false}}, bson.D{{Key: "$set", Value: bson.M{"PasswordHistory": bson.A{}}}})
+			if err != nil {
+				return err
+			}
+			return UserFM.UpdateMany(bson.M{"MustChangePassword": bson.M{"$exists": false}}, bson.D{{Key: "$set", Value: bson.M{"MustChangePassword": false}}})
+		},
+	},
+	{
+		Version:     4,
+		Description: "make configuration names unique within a team instead of globally",
+		Apply: func() error {
+			// The team scoped index is created first, so names stay unique while the global index is dropped
+			err := ConfigFM.EnsureIndex(bson.D{{Key: "Team", Value: 1}, {Key: "Name", Value: 1}}, true)
+			if err != nil {
+				return err
+			}
+			return ConfigFM.DropIndex(bson.D{{Key: "Name", Value: 1}})
+		},
+	},
+	{
+		Version:     5,
+		Description: "give every configuration an immutable ID",
+		Apply: func() error {
+			configs, err := ConfigFM.Get(bson.M{"ID": bson.M{"$exists": false}})
+			if err != nil {
+				return err
+			}
+			for _, config := range configs {
+				filter := bson.M{"Team": config["Team"], "Name": config["Name"], "ID": bson.M{"$exists": false}}
+				err := ConfigFM.Update(filter, bson.D{{Key: "$set", Value: bson.M{"ID": NewConfigID()}}})
+				if err != nil && !errors.Is(err, ErrNotFound) {
+					return err
+				}
+			}
+			return ConfigFM.EnsureIndex(bson.D{{Key: "ID", Value: 1}}, true)
+		},
+	},
+	{
+		Version:     6,
+		Description: "create the teams of configurations and users stored before teams existed",
+		Apply: func() error {
+			names := map[string]bool{}
+			for _, fm := range []FileManager{ConfigFM, UserFM} {
+				documents, err := fm.Get(bson.M{})
+				if err != nil {
+					return err
+				}
+				for _, document := range documents {
+					if team, ok := document["Team"].(string); ok && team != "" && team != SystemTeam {
+						names[team] = true
+					}
+				}
+			}
+			for name := range names {
+				err := TeamFM.Insert(Team{Name: name, Created: time.Now()})
+				if err != nil && !errors.Is(err, ErrDuplicate) {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     7,
+		Description: "date the passwords of accounts created before password ages were stored, their maximum age starts now",
+		Apply: func() error {
+			return UserFM.UpdateMany(bson.M{"PasswordCreated": bson.M{"$exists": false}}, bson.D{{Key: "$set", Value: bson.M{"PasswordCreated": time.Now()}}})
+		},
+	},
+}
+
+func ensureIndexes(indexes []indexspec) error {
+	for _, index := range indexes {
+		if err := index.FM.EnsureIndex(index.Keys, index.Unique); err != nil {
+			return fmt.Errorf("cannot create index %v on %s collection: %s", index.Keys, index.Collection, err)
+		}
+	}
+	return nil
+}
+
+func GetAppliedMigrations() (map[int]MigrationRecord, error) {
+	records, err := MigrationFM.Get(bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := json.Marshal(records)
+	if err != nil {
+		return nil, err
+	}
+	result := []MigrationRecord{}
+	err = json.Unmarshal(bytes, &result)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]MigrationRecord{}
+	for _, record := range result {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// RunMigrations applies pending migrations in order and records each applied version in the migration collection
+func RunMigrations(out io.Writer) error {
+	applied, err := GetAppliedMigrations()
+	if err != nil {
+		return err
+	}
+	for _, migration := range Migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		if err := migration.Apply(); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %s", migration.Version, migration.Description, err)
+		}
+		record := MigrationRecord{Version: migration.Version, Description: migration.Description, Applied: time.Now()}
+		if err := MigrationFM.Insert(record); err != nil && !errors.Is(err, ErrDuplicate) {
+			return err
+		}
+		fmt.Fprintf(out, "migration %d applied: %s\n", migration.Version, migration.Description)
+	}
+	return nil
+}
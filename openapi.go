@@ -0,0 +1,262 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// teamrequest documents the body of the team endpoints, NewName is used by renames and Cascade by removals
+type teamrequest struct {
+	Name    string `json:"Name"`
+	NewName string `json:"NewName,omitempty"`
+	Cascade bool   `json:"Cascade,omitempty"`
+}
+
+type rollbackrequest struct {
+	Revision int `json:"Revision"`
+}
+
+// configrequest documents the configuration fields a request may set, the team comes from the caller or the path,
+// ID and Revision are kept by the service
+type configrequest struct {
+	Name                  string   `json:"Name"`
+	LogPattern            string   `json:"LogPattern,omitempty"`
+	LogSeverity           string   `json:"LogSeverity"`
+	NotificationMethod    string   `json:"NotificationMethod"`
+	LogLogic              string   `json:"LogLogic"`
+	NotificationRecipient []string `json:"NotificationRecipient"`
+	HoldTime              int      `json:"HoldTime,omitempty"`
+	RetryCount            int      `json:"RetryCount,omitempty"`
+}
+
+// configchangerequest identifies the configuration changed through /api/1/config by ID, or by Name without one
+type configchangerequest struct {
+	ID string `json:"ID,omitempty"`
+	configrequest
+}
+
+type configreference struct {
+	ID   string `json:"ID,omitempty"`
+	Name string `json:"Name,omitempty"`
+}
+
+type userrequest struct {
+	Team               string `json:"Team"`
+	Name               string `json:"Name"`
+	Password           string `json:"Password"`
+	MustChangePassword bool   `json:"MustChangePassword,omitempty"`
+}
+
+// passwordrequest sets the password, or only MustChangePassword which system users may set
+type passwordrequest struct {
+	Password           string `json:"Password,omitempty"`
+	MustChangePassword bool   `json:"MustChangePassword,omitempty"`
+}
+
+// userchangerequest names the user changed through /api/1/user, the caller without a Name
+type userchangerequest struct {
+	Name string `json:"Name,omitempty"`
+	passwordrequest
+}
+
+type userreference struct {
+	Name string `json:"Name"`
+}
+
+// apioperation describes one route of the router, the OpenAPI document is built from these and the Go types they name
+type apioperation struct {
+	Method   string
+	Path     string // in gin syntax, e.g. /api/1/config/:name
+	Summary  string
+	Query    []string
+	Headers  []string
+	Request  interface{}
+	Response interface{} // body of the successful response, nil for responses which are not JSON
+	Status   int         // of the successful response, 200 when not set
+	Public   bool        // served without authentication
+}
+
+var paginationQuery = []string{"page", "limit"}
+
+var apiOperations = []apioperation{
+	{Method: "GET", Path: "/metrics", Summary: "Prometheus metrics", Public: true},
+	{Method: "GET", Path: "/healthz", Summary: "Liveness of the process", Response: map[string]string{}, Public: true},
+	{Method: "GET", Path: "/readyz", Summary: "Readiness including every dependency", Response: readiness{}, Public: true},
+	{Method: "GET", Path: "/api/openapi.json", Summary: "This document", Response: map[string]interface{}{}, Public: true},
+	{Method: "GET", Path: "/api/1/config", Summary: "List the configurations of the caller's team", Response: []TeamConfig{}},
+	{Method: "POST", Path: "/api/1/config", Summary: "Add a configuration", Request: configrequest{}, Response: httpresponse{}},
+	{Method: "PUT", Path: "/api/1/config", Summary: "Update a configuration identified by ID or Name", Headers: []string{"If-Match"}, Request: configchangerequest{}, Response: httpresponse{}},
+	{Method: "DELETE", Path: "/api/1/config", Summary: "Remove a configuration identified by ID or Name", Headers: []string{"If-Match"}, Request: configreference{}, Response: httpresponse{}},
+	{Method: "GET", Path: "/api/1/config/export", Summary: "Export the team's configurations as a bundle", Query: []string{"format"}, Response: ConfigBundle{}},
+	{Method: "POST", Path: "/api/1/config/import", Summary: "Import a bundle of configurations", Query: []string{"dryRun", "prune"}, Request: ConfigBundle{}, Response: importresult{}},
+	{Method: "POST", Path: "/api/1/config/sync", Summary: "Plan or apply the desired state of the team's configurations, applying needs MongoDB as a replica set", Query: []string{"planId"}, Request: ConfigBundle{}, Response: syncresult{}},
+	{Method: "GET", Path: "/api/1/config/id/:id", Summary: "Get a configuration by its ID", Response: TeamConfig{}},
+	{Method: "GET", Path: "/api/1/config/:name", Summary: "Get a configuration by its name", Response: TeamConfig{}},
+	{Method: "GET", Path: "/api/1/config/:name/revisions", Summary: "List the revisions of a configuration", Query: paginationQuery, Response: revisionlist{}},
+	{Method: "GET", Path: "/api/1/config/:name/revisions/:revision", Summary: "Get one revision of a configuration", Response: ConfigRevision{}},
+	{Method: "GET", Path: "/api/1/config/:name/diff", Summary: "Compare two revisions of a configuration", Query: []string{"from", "to"}, Response: revisiondiff{}},
+	{Method: "POST", Path: "/api/1/config/:name/rollback", Summary: "Restore a configuration to a revision", Headers: []string{"If-Match"}, Request: rollbackrequest{}, Response: httpresponse{}},
+	{Method: "GET", Path: "/api/1/team", Summary: "List teams", Response: []Team{}},
+	{Method: "POST", Path: "/api/1/team", Summary: "Add a team", Request: teamrequest{}, Response: httpresponse{}},
+	{Method: "PUT", Path: "/api/1/team", Summary: "Rename a team", Request: teamrequest{}, Response: httpresponse{}},
+	{Method: "DELETE", Path: "/api/1/team", Summary: "Remove a team", Request: teamrequest{}, Response: httpresponse{}},
+	{Method: "GET", Path: "/api/1/audit", Summary: "Search the audit log", Query: append([]string{"actor", "team", "action", "target", "outcome", "from", "to"}, paginationQuery...), Response: auditlist{}},
+	{Method: "GET", Path: "/api/1/user", Summary: "List users", Query: append([]string{"team"}, paginationQuery...), Response: userlist{}},
+	{Method: "GET", Path: "/api/1/user/:name", Summary: "Get a user", Response: ApiUser{}},
+	{Method: "POST", Path: "/api/1/user", Summary: "Add a user", Request: userrequest{}, Response: httpresponse{}},
+	{Method: "PUT", Path: "/api/1/user", Summary: "Change the password or flags of a user", Request: userchangerequest{}, Response: httpresponse{}},
+	{Method: "DELETE", Path: "/api/1/user", Summary: "Remove a user", Request: userreference{}, Response: httpresponse{}},
+	{Method: "GET", Path: "/api/2/teams/:team/configs", Summary: "List the configurations of a team", Query: paginationQuery, Response: configpage{}},
+	{Method: "POST", Path: "/api/2/teams/:team/configs", Summary: "Add a configuration, answers 201 with its Location", Status: 201, Request: configrequest{}, Response: TeamConfig{}},
+	{Method: "GET", Path: "/api/2/teams/:team/configs/:name", Summary: "Get a configuration", Response: TeamConfig{}},
+	{Method: "PUT", Path: "/api/2/teams/:team/configs/:name", Summary: "Update a configuration, a different Name renames it", Headers: []string{"If-Match"}, Request: configrequest{}, Response: TeamConfig{}},
+	{Method: "DELETE", Path: "/api/2/teams/:team/configs/:name", Summary: "Remove a configuration", Headers: []string{"If-Match"}, Status: 204},
+	{Method: "GET", Path: "/api/2/users", Summary: "List users", Query: append([]string{"team"}, paginationQuery...), Response: userpage{}},
+	{Method: "POST", Path: "/api/2/users", Summary: "Add a user, answers 201 with its Location", Status: 201, Request: userrequest{}, Response: ApiUser{}},
+	{Method: "GET", Path: "/api/2/users/:name", Summary: "Get a user", Response: ApiUser{}},
+	{Method: "PUT", Path: "/api/2/users/:name", Summary: "Change the password or flags of a user", Status: 204, Request: passwordrequest{}},
+	{Method: "DELETE", Path: "/api/2/users/:name", Summary: "Remove a user", Status: 204},
+}
+
+var routeParam = regexp.MustCompile(`:([A-Za-z]+)`)
+
+// OpenAPIPath converts a gin route such as /api/1/config/:name to /api/1/config/{name}
+func OpenAPIPath(route string) string {
+	return routeParam.ReplaceAllString(route, "{$1}")
+}
+
+// OpenAPIDocument builds the OpenAPI 3 document of the operations, the schemas are generated from the Go types so they follow every field change
+func OpenAPIDocument(operations []apioperation) gin.H {
+	schemas := gin.H{}
+	paths := gin.H{}
+	for _, operation := range operations {
+		item, ok := paths[OpenAPIPath(operation.Path)].(gin.H)
+		if !ok {
+			item = gin.H{}
+			paths[OpenAPIPath(operation.Path)] = item
+		}
+		parameters := []gin.H{}
+		for _, match := range routeParam.FindAllStringSubmatch(operation.Path, -1) {
+			parameters = append(parameters, gin.H{"name": match[1], "in": "path", "required": true, "schema": gin.H{"type": "string"}})
+		}
+		for _, query := range operation.Query {
+			parameters = append(parameters, gin.H{"name": query, "in": "query", "schema": gin.H{"type": "string"}})
+		}
+		for _, header := range operation.Headers {
+			parameters = append(parameters, gin.H{"name": header, "in": "header", "schema": gin.H{"type": "string"}})
+		}
+		success := gin.H{"description": "Success"}
+		if operation.Response != nil {
+			success["content"] = gin.H{"application/json": gin.H{"schema": jsonSchema(reflect.TypeOf(operation.Response), schemas)}}
+		}
+		status := "200"
+		if operation.Status != 0 {
+			status = strconv.Itoa(operation.Status)
+		}
+		responses := gin.H{status: success}
+		if !operation.Public {
+			responses["default"] = gin.H{
+				"description": "Error",
+				"content":     gin.H{"application/json": gin.H{"schema": jsonSchema(reflect.TypeOf(httpresponse{}), schemas)}},
+			}
+		}
+		spec := gin.H{
+			"summary":     operation.Summary,
+			"operationId": operationID(operation),
+			"responses":   responses,
+		}
+		if len(parameters) > 0 {
+			spec["parameters"] = parameters
+		}
+		if operation.Request != nil {
+			spec["requestBody"] = gin.H{"required": true, "content": gin.H{"application/json": gin.H{"schema": jsonSchema(reflect.TypeOf(operation.Request), schemas)}}}
+		}
+		if operation.Public {
+			spec["security"] = []gin.H{}
+		}
+		item[strings.ToLower(operation.Method)] = spec
+	}
+	return gin.H{
+		"openapi": "3.0.3",
+		"info":    gin.H{"title": "Log2N Config API", "version": "1"},
+		"paths":   paths,
+		"components": gin.H{
+			"schemas":         schemas,
+			"securitySchemes": gin.H{"basicAuth": gin.H{"type": "http", "scheme": "basic"}},
+		},
+		"security": []gin.H{{"basicAuth": []string{}}},
+	}
+}
+
+// operationID names an operation after its method and path, e.g. getApi1ConfigName
+func operationID(operation apioperation) string {
+	id := strings.ToLower(operation.Method)
+	for _, word := range strings.FieldsFunc(operation.Path, func(r rune) bool { return r == '/' || r == ':' || r == '.' }) {
+		id += strings.ToUpper(word[:1]) + word[1:]
+	}
+	return id
+}
+
+// jsonSchema returns the schema of t as encoding/json writes it, structs are added to schemas and referenced by name
+func jsonSchema(t reflect.Type, schemas gin.H) gin.H {
+	if t == reflect.TypeOf(time.Time{}) {
+		return gin.H{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonSchema(t.Elem(), schemas)
+	case reflect.String:
+		return gin.H{"type": "string"}
+	case reflect.Bool:
+		return gin.H{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint16:
+		return gin.H{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return gin.H{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return gin.H{"type": "array", "items": jsonSchema(t.Elem(), schemas)}
+	case reflect.Map:
+		if t.Elem().Kind() == reflect.Interface {
+			return gin.H{"type": "object"}
+		}
+		return gin.H{"type": "object", "additionalProperties": jsonSchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		if _, ok := schemas[t.Name()]; !ok {
+			// registered before the fields so recursive types terminate
+			schemas[t.Name()] = gin.H{}
+			properties := gin.H{}
+			structProperties(t, schemas, properties)
+			schemas[t.Name()] = gin.H{"type": "object", "properties": properties}
+		}
+		return gin.H{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return gin.H{}
+}
+
+// structProperties adds the schema of every field of t to properties, the fields of embedded structs are promoted as encoding/json does
+func structProperties(t reflect.Type, schemas gin.H, properties gin.H) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && name == "" {
+			structProperties(field.Type, schemas, properties)
+			continue
+		}
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = jsonSchema(field.Type, schemas)
+	}
+}
+
+func GetOpenAPI(c *gin.Context) {
+	c.JSON(200, OpenAPIDocument(apiOperations))
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var RevisionFM FileManager
+
+type ConfigRevision struct {
+	ID       string    `bson:"ID,omitempty" json:"ID,omitempty"` // of the configuration, kept so that a removed configuration is restored with it
+	Team     string    `bson:"Team" json:"Team"`
+	Name     string    `bson:"Name" json:"Name"`
+	Revision int       `bson:"Revision" json:"Revision"`
+	Action   string    `bson:"Action" json:"Action"`
+	Actor    string    `bson:"Actor" json:"Actor"`
+	Time     time.Time `bson:"Time" json:"Time"`
+	Config   bson.M    `bson:"Config" json:"Config"`
+}
+
+type revisionlist struct {
+	Revisions []ConfigRevision
+	Total     int64
+	Page      int64
+	Limit     int64
+}
+
+type revisiondiff struct {
+	From    int
+	To      int
+	Changes map[string]FieldChange
+}
+
+// ConfigSnapshot returns the stored state of a configuration without technical and event fields
+func ConfigSnapshot(config bson.M) bson.M {
+	snapshot := bson.M{}
+	for key, value := range config {
+		if auditIgnored[key] {
+			continue
+		}
+		snapshot[key] = value
+	}
+	return snapshot
+}
+
+func ConverttoConfigRevisions(in interface{}) ([]ConfigRevision, error) {
+	revisions := []ConfigRevision{}
+	bytes, err := json.Marshal(in)
+	if err != nil {
+		return revisions, err
+	}
+	err = json.Unmarshal(bytes, &revisions)
+	if err != nil {
+		return revisions, err
+	}
+	return revisions, err
+}
+
+func GetLatestRevision(ctx context.Context, team string, name string) (int, error) {
+	findOptions := FindOptions{Limit: 1, Sort: bson.D{{Key: "Revision", Value: -1}}}
+	revisions, _, err := RevisionFM.WithContext(ctx).GetPage(bson.M{"Team": team, "Name": name}, findOptions)
+	if err != nil {
+		return 0, err
+	}
+	result, err := ConverttoConfigRevisions(revisions)
+	if err != nil {
+		return 0, err
+	}
+	if len(result) == 0 {
+		return 0, nil
+	}
+	return result[0].Revision, nil
+}
+
+func GetRevision(ctx context.Context, team string, name string, revision int) (ConfigRevision, error) {
+	revisions, err := RevisionFM.WithContext(ctx).Get(bson.M{"Team": team, "Name": name, "Revision": revision})
+	if err != nil {
+		return ConfigRevision{}, err
+	}
+	result, err := ConverttoConfigRevisions(revisions)
+	if err != nil {
+		return ConfigRevision{}, err
+	}
+	if len(result) == 0 {
+		return ConfigRevision{}, fmt.Errorf("%w: no revision found", ErrNotFound)
+	}
+	return result[0], nil
+}
+
+// revisionAttempts bounds the retries of a revision number taken by a concurrent change of the same configuration
+const revisionAttempts = 3
+
+func RecordConfigRevision(ctx context.Context, config bson.M, action string, actor string) error {
+	team := fmt.Sprint(config["Team"])
+	name := fmt.Sprint(config["Name"])
+	id, _ := config["ID"].(string)
+	for attempt := 0; attempt < revisionAttempts; attempt++ {
+		latest, err := GetLatestRevision(ctx, team, name)
+		if err != nil {
+			return err
+		}
+		revision := ConfigRevision{
+			ID:       id,
+			Team:     team,
+			Name:     name,
+			Revision: latest + 1,
+			Action:   action,
+			Actor:    actor,
+			Time:     time.Now(),
+			Config:   ConfigSnapshot(config),
+		}
+		err = RevisionFM.WithContext(ctx).Insert(revision)
+		if !errors.Is(err, ErrDuplicate) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: revision number of %s taken by concurrent changes %d times", ErrConflict, name, revisionAttempts)
+}
+
+// RecordConfigRevisionOrLog is used after a change is already stored, so a failed revision does not fail the request,
+// it is logged and counted by log2n_config_revision_failures_total instead
+func RecordConfigRevisionOrLog(c *gin.Context, config bson.M, action string) {
+	actor := GetUserName(c)
+	if err := RecordConfigRevision(RequestContext(c), config, action, actor); err != nil {
+		revisionFailures.WithLabelValues(action).Inc()
+		RequestLogger(c).Error("cannot record configuration revision", "stage", "AddConfigRevision", "config", config["Name"], "error", err)
+	}
+}
+
+func getRevisionParam(value string, name string) (int, error) {
+	revision, err := strconv.Atoi(value)
+	if err != nil || revision < 1 {
+		return 0, fmt.Errorf("%s must be a positive number", name)
+	}
+	return revision, nil
+}
+
+func GetConfigRevisions(c *gin.Context) {
+	team := c.Params.ByName("Team")
+	name := c.Params.ByName("name")
+	page, limit, err := GetPagination(c)
+	if err != nil {
+		RespondError(c, Invalid(err), fmt.Sprint(err))
+		return
+	}
+	findOptions := FindOptions{
+		Skip:  (page - 1) * limit,
+		Limit: limit,
+		Sort:  bson.D{{Key: "Revision", Value: -1}},
+	}
+	revisions, total, err := RevisionFM.WithContext(RequestContext(c)).GetPage(bson.M{"Team": team, "Name": name}, findOptions)
+	if err != nil {
+		RespondError(c, fmt.Errorf("GetConfigRevisions: %w", err), "")
+		return
+	}
+	result, err := ConverttoConfigRevisions(revisions)
+	if err != nil {
+		RespondError(c, err, "")
+		return
+	}
+	c.IndentedJSON(200, revisionlist{Revisions: result, Total: total, Page: page, Limit: limit})
+}
+
+func GetConfigRevision(c *gin.Context) {
+	team := c.Params.ByName("Team")
+	name := c.Params.ByName("name")
+	number, err := getRevisionParam(c.Params.ByName("revision"), "revision")
+	if err != nil {
+		RespondError(c, Invalid(err), fmt.Sprint(err))
+		return
+	}
+	revision, err := GetRevision(RequestContext(c), team, name, number)
+	if err != nil {
+		RespondError(c, fmt.Errorf("GetConfigRevision: %w", err), fmt.Sprintf("no revision %d found for configuration: %s", number, name))
+		return
+	}
+	c.IndentedJSON(200, revision)
+}
+
+func GetConfigDiff(c *gin.Context) {
+	team := c.Params.ByName("Team")
+	name := c.Params.ByName("name")
+	from, err := getRevisionParam(c.Query("from"), "from")
+	if err != nil {
+		RespondError(c, Invalid(err), fmt.Sprint(err))
+		return
+	}
+	to := 0
+	if value := c.Query("to"); value != "" {
+		to, err = getRevisionParam(value, "to")
+		if err != nil {
+			RespondError(c, Invalid(err), fmt.Sprint(err))
+			return
+		}
+	} else {
+		to, err = GetLatestRevision(RequestContext(c), team, name)
+		if err != nil {
+			RespondError(c, fmt.Errorf("GetLatestRevision: %w", err), "")
+			return
+		}
+	}
+	revisions := []ConfigRevision{}
+	for _, number := range []int{from, to} {
+		revision, err := GetRevision(RequestContext(c), team, name, number)
+		if err != nil {
+			RespondError(c, fmt.Errorf("GetConfigRevision: %w", err), fmt.Sprintf("no revision %d found for configuration: %s", number, name))
+			return
+		}
+		revisions = append(revisions, revision)
+	}
+	c.IndentedJSON(200, revisiondiff{From: from, To: to, Changes: DocumentDiff(revisions[0].Config, revisions[1].Config)})
+}
+
+func RollbackmyConfig(c *gin.Context) {
+	team := c.Params.ByName("Team")
+	name := c.Params.ByName("name")
+	body := rollbackrequest{}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		RespondError(c, Invalid(err), "post body must be in json format with a numeric Revision")
+		return
+	}
+	number := body.Revision
+	if number < 1 {
+		RespondError(c, ErrInvalid, "Revision must be a positive number")
+		return
+	}
+	ifMatch, hasIfMatch, err := GetIfMatch(c)
+	if err != nil {
+		RespondError(c, Invalid(err), "")
+		return
+	}
+	revision, err := GetRevision(RequestContext(c), team, name, number)
+	if err != nil {
+		RespondError(c, fmt.Errorf("GetConfigRevision: %w", err), fmt.Sprintf("no revision %d found for configuration: %s", number, name))
+		return
+	}
+	if revision.Action == "Delete" {
+		RespondError(c, ErrInvalid, fmt.Sprintf("revision %d is a deletion of configuration: %s", number, name))
+		return
+	}
+	snapshot := ConfigSnapshot(revision.Config)
+	snapshot["Team"] = team
+	snapshot["Name"] = name
+	filter := bson.M{"Team": team, "Name": name}
+	storedConfig, err := ConfigFM.WithContext(RequestContext(c)).GetOne(filter)
+	updateType := "Update"
+	var restoredConfig bson.M
+	if errors.Is(err, ErrNotFound) && hasIfMatch {
+		RespondError(c, ErrPreconditionFailed, fmt.Sprintf("no configuration found with name: %s", name))
+		return
+	}
+	if errors.Is(err, ErrNotFound) {
+		// The configuration was removed after the revision, so it is created again without a precondition like a new one
+		updateType = "Add"
+		snapshot["Revision"] = 1
+		snapshot["ID"] = revision.ID
+		if revision.ID == "" {
+			// revisions recorded before configurations had IDs
+			snapshot["ID"] = NewConfigID()
+		}
+		err = ConfigFM.WithContext(RequestContext(c)).Insert(snapshot)
+		restoredConfig = snapshot
+	} else if err == nil {
+		if !hasIfMatch && GlobalConfig.RequireIfMatch {
+			RespondError(c, fmt.Errorf("%w: If-Match header is required", ErrPreconditionRequired), "")
+			return
+		}
+		if hasIfMatch && ifMatch != AnyRevision {
+			if StoredRevision(storedConfig) != ifMatch {
+				RespondError(c, ErrPreconditionFailed, configChangedMessage)
+				return
+			}
+			filter["Revision"] = RevisionFilter(ifMatch)
+		}
+		if len(DocumentDiff(ConfigSnapshot(storedConfig), snapshot)) == 0 {
+			c.IndentedJSON(200, httpresponse{Status: true, Message: noChangeMessage, ID: fmt.Sprint(storedConfig["ID"])})
+			return
+		}
+		unset := bson.M{}
+		for key := range ConfigSnapshot(storedConfig) {
+			if _, ok := snapshot[key]; !ok {
+				unset[key] = ""
+			}
+		}
+		update := bson.D{{Key: "$set", Value: snapshot}, {Key: "$inc", Value: bson.M{"Revision": 1}}}
+		if len(unset) > 0 {
+			update = append(update, bson.E{Key: "$unset", Value: unset})
+		}
+		restoredConfig, err = ConfigFM.WithContext(RequestContext(c)).UpdateAndGet(filter, update)
+		if hasIfMatch && errors.Is(err, ErrNotFound) {
+			RespondError(c, ErrPreconditionFailed, configChangedMessage)
+			return
+		}
+	}
+	if err != nil {
+		RespondError(c, fmt.Errorf("RollbackTeamConfig: %w", err), "")
+		return
+	}
+	SetAuditChange(c, name, storedConfig, restoredConfig)
+	RecordConfigRevisionOrLog(c, restoredConfig, "Rollback")
+	c.Header("ETag", ETag(StoredRevision(restoredConfig)))
+	err = PublishConfigChange(c, restoredConfig, updateType)
+	if err != nil {
+		RespondError(c, err, "")
+		return
+	}
+	c.IndentedJSON(200, httpresponse{Status: true, Message: ""})
+}
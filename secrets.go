@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretsource resolves a secret reference without its scheme prefix to the current secret value
+type secretsource func(reference string) (string, error)
+
+// FileSecret returns the first line of the file, as connection strings were always read
+func FileSecret(path string) (string, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(strings.Split(string(bytes), "\n")[0], "\r"), nil
+}
+
+func EnvSecret(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// VaultSecret returns a source reading references such as secret/data/log2n#configdb from a Vault compatible KV engine, version 1 and 2
+func VaultSecret(address string, token string, client *http.Client) secretsource {
+	return func(reference string) (string, error) {
+		path, key, found := strings.Cut(reference, "#")
+		if !found || path == "" || key == "" {
+			return "", fmt.Errorf("vault secret reference must look like path#key")
+		}
+		request, err := http.NewRequest("GET", strings.TrimRight(address, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+		if err != nil {
+			return "", err
+		}
+		request.Header.Set("X-Vault-Token", token)
+		response, err := client.Do(request)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != 200 {
+			return "", fmt.Errorf("vault returned status %d for %s", response.StatusCode, path)
+		}
+		body := struct {
+			Data map[string]interface{} `json:"data"`
+		}{}
+		if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+			return "", err
+		}
+		data := body.Data
+		// the KV version 2 engine nests the values in data.data
+		if nested, ok := data["data"].(map[string]interface{}); ok {
+			data = nested
+		}
+		value, ok := data[key].(string)
+		if !ok {
+			return "", fmt.Errorf("vault secret %s has no string field %s", path, key)
+		}
+		return value, nil
+	}
+}
+
+type secret struct {
+	reference string
+	value     string
+}
+
+// SecretStore keeps the current values of named secrets, Refresh reads them again so that rotated credentials are used by the next connection
+type SecretStore struct {
+	mutex   sync.RWMutex
+	sources map[string]secretsource
+	secrets map[string]secret
+}
+
+func NewSecretStore(sources map[string]secretsource) *SecretStore {
+	return &SecretStore{sources: sources, secrets: map[string]secret{}}
+}
+
+// resolve reads a reference like file:/run/secrets/db, env:MONGO_URI or vault:secret/data/log2n#configdb, a reference without a known scheme is a file path
+func (s *SecretStore) resolve(reference string) (string, error) {
+	scheme, rest, found := strings.Cut(reference, ":")
+	source, ok := s.sources[scheme]
+	if !found || !ok {
+		return FileSecret(reference)
+	}
+	return source(rest)
+}
+
+// Add resolves the secret once and keeps its reference for later refreshes
+func (s *SecretStore) Add(name string, reference string) (string, error) {
+	value, err := s.resolve(reference)
+	if err != nil {
+		return "", fmt.Errorf("cannot read secret %s: %s", name, err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.secrets[name] = secret{reference: reference, value: value}
+	return value, nil
+}
+
+func (s *SecretStore) Value(name string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	stored, ok := s.secrets[name]
+	return stored.value, ok
+}
+
+// Refresh reads every secret again and returns the names of the rotated ones, a secret which cannot be read keeps its previous value
+func (s *SecretStore) Refresh() []string {
+	s.mutex.RLock()
+	current := map[string]secret{}
+	for name, stored := range s.secrets {
+		current[name] = stored
+	}
+	s.mutex.RUnlock()
+	rotated := []string{}
+	for name, stored := range current {
+		value, err := s.resolve(stored.reference)
+		if err != nil {
+			Logger.Warn("cannot refresh secret, keeping the previous value", "secret", name, "error", err)
+			continue
+		}
+		if value == "" || value == stored.value {
+			continue
+		}
+		s.mutex.Lock()
+		s.secrets[name] = secret{reference: stored.reference, value: value}
+		s.mutex.Unlock()
+		rotated = append(rotated, name)
+		Logger.Info("secret rotated, new connections use the new value", "secret", name)
+	}
+	return rotated
+}
+
+// Watch refreshes the secrets every interval until ctx is cancelled
+func (s *SecretStore) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Refresh()
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// draining is set once shutdown starts so that readiness fails while in-flight requests finish
+var draining atomic.Bool
+
+// Serve runs the server on listener until ctx is cancelled. Readiness then fails for preStopDelay while requests are still
+// accepted, so that load balancers stop routing to this replica, before the server stops accepting connections and waits up
+// to drainTimeout for in-flight requests
+func Serve(ctx context.Context, server *http.Server, listener net.Listener, preStopDelay time.Duration, drainTimeout time.Duration) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			// the certificate is served by TLSConfig.GetCertificate
+			serveErr <- server.ServeTLS(listener, "", "")
+			return
+		}
+		serveErr <- server.Serve(listener)
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	draining.Store(true)
+	if preStopDelay > 0 {
+		Logger.Info("shutting down, waiting for load balancers to notice", "delay", preStopDelay.String())
+		select {
+		case err := <-serveErr:
+			return err
+		case <-time.After(preStopDelay):
+		}
+	}
+	Logger.Info("shutting down, draining in-flight requests", "timeout", drainTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+		return err
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown releases the background workers once no request can use them anymore, the publisher first and the span exporter last
+func Shutdown(ctx context.Context, shutdownTracing func(context.Context) error) {
+	CM.Stop()
+	if err := shutdownTracing(ctx); err != nil {
+		Logger.Error("cannot flush traces", "error", err)
+	}
+	Logger.Info("shutdown complete")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const planChangedMessage = "stored configurations changed since the plan was made. Please review the new plan and confirm it"
+
+type syncresult struct {
+	Applied bool
+	PlanID  string
+	Summary bson.M
+	Plan    []PlanItem
+}
+
+// GetPlanID identifies a plan, so a confirmed apply fails when stored configurations changed after the plan was shown
+func GetPlanID(plan []PlanItem) (string, error) {
+	bytes, err := json.Marshal(plan)
+	if err != nil {
+		return "", err
+	}
+	return GetHash(string(bytes)), nil
+}
+
+// SyncOperations converts a plan to storage operations and returns the documents which are published after the apply
+func SyncOperations(plan []PlanItem, desired []TeamConfig, stored []TeamConfig, team string) ([]DocOperation, map[string]bson.M, error) {
+	desiredByName := map[string]TeamConfig{}
+	for _, config := range desired {
+		desiredByName[config.Name] = config
+	}
+	storedByName := map[string]TeamConfig{}
+	for _, config := range stored {
+		storedByName[config.Name] = config
+	}
+	operations := []DocOperation{}
+	documents := map[string]bson.M{}
+	for _, item := range plan {
+		filter := bson.M{"Team": team, "Name": item.Name}
+		switch item.Action {
+		case "Create":
+			document, err := TeamConfigDocument(desiredByName[item.Name], team)
+			if err != nil {
+				return nil, nil, err
+			}
+			document["Revision"] = 1
+			document["ID"] = NewConfigID()
+			operations = append(operations, DocOperation{Action: "Insert", Document: document})
+			documents[item.Name] = document
+		case "Update":
+			document, err := TeamConfigDocument(desiredByName[item.Name], team)
+			if err != nil {
+				return nil, nil, err
+			}
+			revision := storedByName[item.Name].Revision
+			filter["Revision"] = RevisionFilter(revision)
+			update := bson.D{
+				{Key: "$set", Value: document},
+				{Key: "$inc", Value: bson.M{"Revision": 1}},
+			}
+			operations = append(operations, DocOperation{Action: "Update", Filter: filter, Document: update})
+			document["Revision"] = revision + 1
+			document["ID"] = storedByName[item.Name].ID
+			documents[item.Name] = document
+		case "Delete":
+			document, err := TeamConfigDocument(storedByName[item.Name], team)
+			if err != nil {
+				return nil, nil, err
+			}
+			document["ID"] = storedByName[item.Name].ID
+			filter["Revision"] = RevisionFilter(storedByName[item.Name].Revision)
+			operations = append(operations, DocOperation{Action: "Delete", Filter: filter})
+			documents[item.Name] = document
+		}
+	}
+	return operations, documents, nil
+}
+
+func SyncmyConfigs(c *gin.Context) {
+	team := c.Params.ByName("Team")
+	confirmedPlanID := c.Query("planId")
+	bundle, err := BindConfigBundle(c)
+	if err != nil {
+		RespondError(c, Invalid(err), fmt.Sprint(err))
+		return
+	}
+	err = ValidateConfigBundle(bundle, team)
+	if err != nil {
+		RespondError(c, Invalid(err), fmt.Sprint(err))
+		return
+	}
+	exists, err := TeamExists(RequestContext(c), team)
+	if err == nil && !exists {
+		RespondError(c, ErrNotFound, fmt.Sprintf("no team found with name: %s", team))
+		return
+	}
+	stored := []TeamConfig{}
+	if err == nil {
+		stored, err = GetTeamConfigs(RequestContext(c), team)
+	}
+	if err != nil {
+		RespondError(c, fmt.Errorf("GetTeamConfigs: %w", err), "")
+		return
+	}
+	plan, err := PlanConfigChanges(bundle.Configs, stored, team, true)
+	if err != nil {
+		RespondError(c, err, "")
+		return
+	}
+	planID, err := GetPlanID(plan)
+	if err != nil {
+		RespondError(c, err, "")
+		return
+	}
+	result := syncresult{Applied: false, PlanID: planID, Summary: PlanSummary(plan), Plan: plan}
+	if confirmedPlanID == "" {
+		c.IndentedJSON(200, result)
+		return
+	}
+	if confirmedPlanID != planID {
+		RespondError(c, ErrPreconditionFailed, planChangedMessage)
+		return
+	}
+	operations, documents, err := SyncOperations(plan, bundle.Configs, stored, team)
+	if err != nil {
+		RespondError(c, err, "")
+		return
+	}
+	if len(operations) > 0 {
+		err = ConfigFM.WithContext(RequestContext(c)).Apply(operations)
+	}
+	if errors.Is(err, ErrNotFound) {
+		RespondError(c, ErrPreconditionFailed, planChangedMessage)
+		return
+	}
+	if errors.Is(err, ErrTransactionsUnsupported) {
+		RespondOutcome(c, fmt.Errorf("ApplyTeamConfigs: %w", err), fmt.Sprintf("Plan was not applied, no configuration was changed. %s", ErrTransactionsUnsupported))
+		return
+	}
+	if err != nil {
+		RespondOutcome(c, fmt.Errorf("ApplyTeamConfigs: %w", err), "Plan was not applied, no configuration was changed. Please retry")
+		return
+	}
+	SetAuditChange(c, team, nil, result.Summary)
+	updateTypes := map[string]string{"Create": "Add", "Update": "Update", "Delete": "Delete"}
+	unpublished := []string{}
+	publishErrors := []error{}
+	for _, item := range plan {
+		document, ok := documents[item.Name]
+		if !ok {
+			continue
+		}
+		RecordConfigRevisionOrLog(c, document, updateTypes[item.Action])
+		if err := PublishConfigChange(c, document, updateTypes[item.Action]); err != nil {
+			unpublished = append(unpublished, item.Name)
+			publishErrors = append(publishErrors, err)
+		}
+	}
+	if len(unpublished) > 0 {
+		message := fmt.Sprintf("Plan was applied but the changes of %s were not published", strings.Join(unpublished, ", "))
+		RespondOutcome(c, errors.Join(publishErrors...), message)
+		return
+	}
+	result.Applied = true
+	c.IndentedJSON(200, result)
+}
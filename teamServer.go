@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var TeamFM FileManager
+
+// SystemTeam is the built-in team of administrators which always exists and cannot be renamed or removed
+const SystemTeam = "System"
+
+func ConverttoTeams(in interface{}) ([]Team, error) {
+	teams := []Team{}
+	bytes, err := json.Marshal(in)
+	if err != nil {
+		return teams, err
+	}
+	err = json.Unmarshal(bytes, &teams)
+	if err != nil {
+		return teams, err
+	}
+	return teams, err
+}
+
+func TeamExists(ctx context.Context, name string) (bool, error) {
+	if name == SystemTeam {
+		return true, nil
+	}
+	if name == "" {
+		return false, nil
+	}
+	teams, err := TeamFM.WithContext(ctx).Get(bson.M{"Name": name})
+	if err != nil {
+		return false, err
+	}
+	return len(teams) > 0, nil
+}
+
+func GetTeams(c *gin.Context) {
+	isSystemAuthorized := c.Params.ByName("isAuthorized")
+	filter := bson.M{}
+	if isSystemAuthorized == "false" {
+		filter["Name"] = c.Params.ByName("Team")
+	}
+	teams, err := TeamFM.WithContext(RequestContext(c)).Get(filter)
+	if err != nil {
+		RespondError(c, fmt.Errorf("GetTeams: %w", err), "")
+		return
+	}
+	result, err := ConverttoTeams(teams)
+	if err != nil {
+		RespondError(c, err, "")
+		return
+	}
+	c.IndentedJSON(200, result)
+}
+
+func AddTeam(c *gin.Context) {
+	isSystemAuthorized := c.Params.ByName("isAuthorized")
+	if isSystemAuthorized == "false" {
+		RespondError(c, ErrForbidden, "Not authorized")
+		return
+	}
+	team := bson.M{}
+	if err := c.ShouldBindJSON(&team); err != nil {
+		RespondError(c, Invalid(err), "post body must be in json format")
+		return
+	}
+	name, ok := team["Name"].(string)
+	if !ok || name == "" {
+		RespondError(c, ErrInvalid, "Name field cannot be null or empty")
+		return
+	}
+	exists, err := TeamExists(RequestContext(c), name)
+	if err == nil && exists {
+		RespondError(c, ErrDuplicate, fmt.Sprintf("Team %s already exist", name))
+		return
+	}
+	if err == nil {
+		err = TeamFM.WithContext(RequestContext(c)).Insert(Team{Name: name, Created: time.Now()})
+	}
+	if err != nil {
+		RespondError(c, fmt.Errorf("AddTeam: %w", err), fmt.Sprintf("Team %s already exist", name))
+		return
+	}
+	SetAuditChange(c, name, nil, bson.M{"Name": name})
+	c.IndentedJSON(200, httpresponse{Status: true, Message: ""})
+}
+
+func SetTeam(c *gin.Context) {
+	isSystemAuthorized := c.Params.ByName("isAuthorized")
+	if isSystemAuthorized == "false" {
+		RespondError(c, ErrForbidden, "Not authorized")
+		return
+	}
+	team := bson.M{}
+	if err := c.ShouldBindJSON(&team); err != nil {
+		RespondError(c, Invalid(err), "post body must be in json format")
+		return
+	}
+	name, _ := team["Name"].(string)
+	newName, _ := team["NewName"].(string)
+	if name == "" || newName == "" {
+		RespondError(c, ErrInvalid, "Name and NewName fields cannot be null or empty")
+		return
+	}
+	if name == SystemTeam || newName == SystemTeam {
+		RespondError(c, ErrForbidden, fmt.Sprintf("Team %s cannot be renamed", SystemTeam))
+		return
+	}
+	exists, err := TeamExists(RequestContext(c), newName)
+	if err == nil && exists {
+		RespondError(c, ErrDuplicate, fmt.Sprintf("Team %s already exist", newName))
+		return
+	}
+	if err == nil {
+		err = TeamFM.WithContext(RequestContext(c)).Update(bson.M{"Name": name}, bson.D{{Key: "$set", Value: bson.M{"Name": newName}}})
+	}
+	if err != nil {
+		RespondError(c, fmt.Errorf("SetTeam: %w", err), fmt.Sprintf("no team found with name: %s", name))
+		return
+	}
+	SetAuditChange(c, name, bson.M{"Name": name}, bson.M{"Name": newName})
+	update := bson.D{{Key: "$set", Value: bson.M{"Team": newName}}}
+	err = UserFM.WithContext(RequestContext(c)).UpdateMany(bson.M{"Team": name}, update)
+	if err == nil {
+		err = ConfigFM.WithContext(RequestContext(c)).UpdateMany(bson.M{"Team": name}, update)
+	}
+	if err == nil {
+		err = RevisionFM.WithContext(RequestContext(c)).UpdateMany(bson.M{"Team": name}, update)
+	}
+	if err != nil {
+		RespondError(c, fmt.Errorf("SetTeamMembers: %w", err), "")
+		return
+	}
+	configs, err := ConfigFM.WithContext(RequestContext(c)).Get(bson.M{"Team": newName})
+	if err != nil {
+		RespondError(c, err, "")
+		return
+	}
+	for _, config := range configs {
+		config["PreviousTeam"] = name
+	}
+	if unpublished, err := PublishConfigChanges(c, configs, "Update"); err != nil {
+		RespondOutcome(c, err, fmt.Sprintf("Team %s was renamed but the changes of %s were not published", name, strings.Join(unpublished, ", ")))
+		return
+	}
+	c.IndentedJSON(200, httpresponse{Status: true, Message: ""})
+}
+
+func RemoveTeam(c *gin.Context) {
+	isSystemAuthorized := c.Params.ByName("isAuthorized")
+	if isSystemAuthorized == "false" {
+		RespondError(c, ErrForbidden, "Not authorized")
+		return
+	}
+	team := bson.M{}
+	if err := c.ShouldBindJSON(&team); err != nil {
+		RespondError(c, Invalid(err), "post body must be in json format")
+		return
+	}
+	name, _ := team["Name"].(string)
+	if name == "" {
+		RespondError(c, ErrInvalid, "Name field cannot be null or empty")
+		return
+	}
+	if name == SystemTeam {
+		RespondError(c, ErrForbidden, fmt.Sprintf("Team %s cannot be removed", SystemTeam))
+		return
+	}
+	cascade, _ := team["Cascade"].(bool)
+	filter := bson.M{"Team": name}
+	configs, err := ConfigFM.WithContext(RequestContext(c)).Get(filter)
+	if err != nil {
+		RespondError(c, fmt.Errorf("GetTeamConfigs: %w", err), "")
+		return
+	}
+	users, err := UserFM.WithContext(RequestContext(c)).Get(filter)
+	if err != nil {
+		RespondError(c, fmt.Errorf("GetTeamUsers: %w", err), "")
+		return
+	}
+	if (len(configs) > 0 || len(users) > 0) && !cascade {
+		message := fmt.Sprintf("Team %s still has %d configurations and %d users. Set Cascade to true to remove them", name, len(configs), len(users))
+		RespondError(c, ErrConflict, message)
+		return
+	}
+	err = TeamFM.WithContext(RequestContext(c)).Delete(bson.M{"Name": name})
+	if err != nil {
+		RespondError(c, fmt.Errorf("RemoveTeam: %w", err), fmt.Sprintf("no team found with name: %s", name))
+		return
+	}
+	SetAuditChange(c, name, bson.M{"Name": name, "Configs": len(configs), "Users": len(users)}, nil)
+	if !cascade {
+		c.IndentedJSON(200, httpresponse{Status: true, Message: ""})
+		return
+	}
+	// Revisions are removed with the team, so a team created later with the same name starts a new history
+	err = ConfigFM.WithContext(RequestContext(c)).DeleteMany(filter)
+	if err == nil {
+		err = UserFM.WithContext(RequestContext(c)).DeleteMany(filter)
+	}
+	if err == nil {
+		err = RevisionFM.WithContext(RequestContext(c)).DeleteMany(filter)
+	}
+	if err != nil {
+		RespondError(c, fmt.Errorf("RemoveTeamMembers: %w", err), "")
+		return
+	}
+	if unpublished, err := PublishConfigChanges(c, configs, "Delete"); err != nil {
+		RespondOutcome(c, err, fmt.Sprintf("Team %s was removed but the changes of %s were not published", name, strings.Join(unpublished, ", ")))
+		return
+	}
+	c.IndentedJSON(200, httpresponse{Status: true, Message: ""})
+}
+
+// PublishConfigChanges publishes a change event for every configuration, also after a failed one, and returns the names
+// of the configurations whose events were not published
+func PublishConfigChanges(c *gin.Context, configs []bson.M, updateType string) ([]string, error) {
+	unpublished := []string{}
+	failures := []error{}
+	for _, config := range configs {
+		if err := PublishConfigChange(c, config, updateType); err != nil {
+			unpublished = append(unpublished, fmt.Sprint(config["Name"]))
+			failures = append(failures, err)
+		}
+	}
+	return unpublished, errors.Join(failures...)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type tlsconfig struct {
+	CertFile          string
+	KeyFile           string
+	MinVersion        uint16
+	ClientCAFile      string
+	RequireClientCert bool
+}
+
+func (t tlsconfig) Enabled() bool {
+	return t.CertFile != ""
+}
+
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q, expected 1.2 or 1.3", version)
+}
+
+// certificatereloader serves the key pair from disk and loads it again once either file is replaced, so rotated certificates need no restart
+type certificatereloader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func NewCertificateReloader(certFile string, keyFile string) (*certificatereloader, error) {
+	reloader := &certificatereloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (r *certificatereloader) latestModTime() (time.Time, error) {
+	latest := time.Time{}
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certificatereloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// GetCertificate keeps serving the previous certificate when the rotated files cannot be loaded yet, e.g. the key is written after the certificate
+func (r *certificatereloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if modTime, err := r.latestModTime(); err == nil && modTime.After(r.modTime) {
+		if err := r.reload(); err != nil {
+			Logger.Warn("cannot reload TLS certificate, serving the previous one", "cert", r.certFile, "error", err)
+		} else {
+			Logger.Info("reloaded TLS certificate", "cert", r.certFile)
+		}
+	}
+	return r.cert, nil
+}
+
+func NewTLSConfig(conf tlsconfig) (*tls.Config, error) {
+	reloader, err := NewCertificateReloader(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load TLS certificate: %s", err)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     conf.MinVersion,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if conf.ClientCAFile != "" {
+		pem, err := os.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", conf.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if conf.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tlsConfig, nil
+}
+
+// ClientCertificateName returns the common name of a client certificate verified against the client CA, it names the account of the caller
+func ClientCertificateName(c *gin.Context) (string, bool) {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 || len(c.Request.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	name := c.Request.TLS.VerifiedChains[0][0].Subject.CommonName
+	return name, name != ""
+}
+
+// GetUserName returns the name of the authenticated account, from the client certificate or the Basic Auth credentials
+func GetUserName(c *gin.Context) string {
+	if name := c.GetString("User"); name != "" {
+		return name
+	}
+	user, _, _ := c.Request.BasicAuth()
+	return user
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"regexp"
+	"io"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var ConfigFM FileManager
@@ -28,11 +35,137 @@ func ConverttoTeamConfigs(in interface{}) ([]TeamConfig, error) {
 	return configs, err
 }
 
+func ConverttoApiUsers(in interface{}) ([]ApiUser, error) {
+	users := []ApiUser{}
+	bytes, err := json.Marshal(in)
+	if err != nil {
+		return users, err
+	}
+	err = json.Unmarshal(bytes, &users)
+	if err != nil {
+		return users, err
+	}
+	return users, err
+}
+
+func GetPagination(c *gin.Context) (int64, int64, error) {
+	page, limit := int64(1), int64(50)
+	var err error
+	if value := c.Query("page"); value != "" {
+		page, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || page < 1 {
+			return 0, 0, fmt.Errorf("page must be a positive number")
+		}
+	}
+	if value := c.Query("limit"); value != "" {
+		limit, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || limit < 1 || limit > 500 {
+			return 0, 0, fmt.Errorf("limit must be a number between 1 and 500")
+		}
+	}
+	return page, limit, nil
+}
+
+// PublishConfigChange sends a change event, consumers identify the configuration by its Team and Name
+// and can correlate the event with the API request by its RequestID
+func PublishConfigChange(c *gin.Context, config bson.M, updateType string) error {
+	if config["Team"] == nil || config["Name"] == nil {
+		return fmt.Errorf("change event must have Team and Name fields")
+	}
+	config["UpdateType"] = updateType
+	config["UpdateTime"] = time.Now()
+	config["RequestID"] = GetRequestID(c)
+	ctx, span := tracer().Start(RequestContext(c), "publish "+updateType, trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		semconv.MessagingSystemRabbitmq,
+		attribute.String("config.team", fmt.Sprint(config["Team"])),
+		attribute.String("config.name", fmt.Sprint(config["Name"])),
+	))
+	defer span.End()
+	err := CM.Do(eventmessage{Event: config, Headers: InjectTraceContext(ctx)})
+	ObservePublish(updateType, err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("%w: cannot publish change event: %s", ErrUnavailable, err)
+	}
+	return nil
+}
+
+func ETag(revision int) string {
+	return fmt.Sprintf("\"%d\"", revision)
+}
+
+func StoredRevision(config bson.M) int {
+	switch revision := config["Revision"].(type) {
+	case float64:
+		return int(revision)
+	case int:
+		return revision
+	case int32:
+		return int(revision)
+	case int64:
+		return int(revision)
+	}
+	return 0
+}
+
+// AnyRevision is returned by GetIfMatch for If-Match: *, which only requires the configuration to exist
+const AnyRevision = -1
+
+// GetIfMatch returns the revision given in If-Match header and whether the header was provided at all
+func GetIfMatch(c *gin.Context) (int, bool, error) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" {
+		return 0, false, nil
+	}
+	if header == "*" {
+		return AnyRevision, true, nil
+	}
+	header = strings.Trim(strings.TrimPrefix(header, "W/"), "\"")
+	revision, err := strconv.Atoi(header)
+	if err != nil || revision < 0 {
+		return 0, true, fmt.Errorf("If-Match header must contain an ETag returned by the API")
+	}
+	return revision, true, nil
+}
+
+// RevisionFilter matches documents created before revisions were introduced for revision 0
+func RevisionFilter(revision int) interface{} {
+	if revision == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+	return revision
+}
+
+// NewConfigID returns the immutable identity given to a configuration when it is created
+func NewConfigID() string {
+	return primitive.NewObjectID().Hex()
+}
+
+// ConfigFilter finds a configuration by its ID when one is given, otherwise by its name within the team
+func ConfigFilter(team string, config bson.M) bson.M {
+	if id, ok := config["ID"].(string); ok && id != "" {
+		return bson.M{"Team": team, "ID": id}
+	}
+	return bson.M{"Team": team, "Name": config["Name"]}
+}
+
+// ConfigReference describes a configuration filter in messages
+func ConfigReference(filter bson.M) string {
+	if id, ok := filter["ID"]; ok {
+		return fmt.Sprintf("id: %s", id)
+	}
+	return fmt.Sprintf("name: %s", filter["Name"])
+}
+
 func SetConfigValidate(config bson.M) error {
 	value, ok := config["Team"]
 	if !ok || value == "" {
 		return fmt.Errorf("cannot find property team")
 	}
+	if id, ok := config["ID"].(string); ok && id != "" {
+		return nil
+	}
 	value, ok = config["Name"]
 	if !ok || value == "" {
 		return fmt.Errorf("cannot find property name")
@@ -62,384 +195,617 @@ func AddUserValidation(user bson.M) error {
 }
 
 func Authenticate(c *gin.Context) {
+	if name, ok := ClientCertificateName(c); ok {
+		AuthenticateCertificate(c, name)
+		return
+	}
 	user, password, ok := c.Request.BasicAuth()
 	if !ok {
-		c.Abort()
-		c.IndentedJSON(403, httpresponse{Status: false, Message: "Not authecticated"})
+		authFailures.WithLabelValues("missing_credentials").Inc()
+		c.Header("WWW-Authenticate", "Basic")
+		RespondError(c, ErrUnauthorized, "Not authecticated")
 		return
 	}
 	filter := bson.M{"Name": user}
-	userAccount, err := UserFM.GetOne(filter)
-	if err != nil || userAccount["Password"] != GetHash(password) {
-		if err != nil {
-			log.Println(err)
-		}
-		c.Abort()
-		c.IndentedJSON(403, httpresponse{Status: false, Message: "Not authecticated"})
+	userAccount, err := UserFM.WithContext(RequestContext(c)).GetOne(filter)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		RespondError(c, fmt.Errorf("GetUser: %w", err), "")
+	} else if err != nil || userAccount["Password"] != GetHash(password) {
+		authFailures.WithLabelValues("invalid_credentials").Inc()
+		c.Header("WWW-Authenticate", "Basic")
+		RespondError(c, ErrUnauthorized, "Not authecticated")
+	} else if GlobalConfig.PasswordPolicy.IsExpired(userAccount) && !isPasswordChange(c, user) {
+		authFailures.WithLabelValues("password_expired").Inc()
+		RespondError(c, ErrForbidden, "Password expired. Please change your password")
 	} else {
+		c.Set("User", user)
 		c.Params = append(c.Params, gin.Param{Key: "Team", Value: userAccount["Team"].(string)})
 	}
 }
 
-func PasswordComplexityCheck(password string) bool {
-	regx, err := regexp.MatchString("[a-z]", password)
-	if err != nil || !regx {
-		return false
+// AuthenticateCertificate maps the common name of a verified client certificate to the account of the same name, passwords are not checked
+func AuthenticateCertificate(c *gin.Context, name string) {
+	userAccount, err := UserFM.WithContext(RequestContext(c)).GetOne(bson.M{"Name": name})
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		RespondError(c, fmt.Errorf("GetUser: %w", err), "")
+		return
 	}
-	regx, err = regexp.MatchString("[A-Z]", password)
-	if err != nil || !regx {
-		return false
+	if err != nil {
+		authFailures.WithLabelValues("unknown_certificate").Inc()
+		RespondError(c, ErrUnauthorized, fmt.Sprintf("no account found for client certificate %s", name))
+		return
 	}
-	regx, err = regexp.MatchString("\\d", password)
-	if err != nil || !regx {
+	c.Set("User", name)
+	c.Set("CertificateAuthenticated", true)
+	c.Params = append(c.Params, gin.Param{Key: "Team", Value: fmt.Sprint(userAccount["Team"])})
+}
+
+// isPasswordChange tells the request a user with an expired password may still make, setting a new password of their own.
+// The body is read here and restored for the handler
+func isPasswordChange(c *gin.Context, user string) bool {
+	if c.Request.Method != "PUT" || (c.FullPath() != "/api/1/user" && c.FullPath() != "/api/2/users/:name") {
 		return false
 	}
-	if len(password) < 8 {
+	content, err := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(content))
+	body := bson.M{}
+	if err != nil || json.Unmarshal(content, &body) != nil {
 		return false
 	}
-	return true
+	// /api/1/user changes the password of the caller when the body has no Name, /api/2 names the user in the path
+	name, _ := body["Name"].(string)
+	if c.FullPath() == "/api/2/users/:name" {
+		name = c.Params.ByName("name")
+	}
+	password, _ := body["Password"].(string)
+	return (name == "" || name == user) && password != ""
+}
+
+func PasswordComplexityCheck(password string) bool {
+	return len(GetPasswordPolicyDefaultInstance().Check(password, "")) == 0
+}
+
+func PasswordPolicyMessage(failed []string) string {
+	return fmt.Sprintf("Provided password doesn't meet required complexity: %s", strings.Join(failed, "; "))
 }
 
 func SystemAuthorize(c *gin.Context) {
+	if c.GetBool("CertificateAuthenticated") {
+		if c.Params.ByName("Team") != SystemTeam {
+			c.Params = append(c.Params, gin.Param{Key: "isAuthorized", Value: "false"})
+		}
+		return
+	}
 	user, password, _ := c.Request.BasicAuth()
 	filter := bson.M{"Name": user}
-	userAccount, err := UserFM.GetOne(filter)
+	userAccount, err := UserFM.WithContext(RequestContext(c)).GetOne(filter)
 	if err != nil || userAccount["Team"] != "System" || userAccount["Password"] != GetHash(password) {
-		if err != nil {
-			log.Println(err)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			RequestLogger(c).Error("cannot authorize user", "stage", "GetUser", "error", err)
 		}
 		c.Params = append(c.Params, gin.Param{Key: "isAuthorized", Value: "false"})
 		return
 	}
 }
 
+// GetmyConfig answers without an ETag, If-Match applies to one configuration and the list has no revision of its own.
+// Every item carries its Revision, which is the ETag of that configuration
 func GetmyConfig(c *gin.Context) {
 	team := c.Params.ByName("Team")
 	filter := bson.M{"Team": team}
-	configs, err := ConfigFM.Get(filter)
+	configs, err := ConfigFM.WithContext(RequestContext(c)).Get(filter)
 	if err != nil {
-		c.IndentedJSON(424, httpresponse{Status: false, Message: fmt.Sprint(err)})
+		RespondError(c, err, "")
 		return
 	}
 	teamconfigs, err := ConverttoTeamConfigs(configs)
 	if err != nil {
-		c.IndentedJSON(424, httpresponse{Status: false, Message: fmt.Sprint(err)})
+		RespondError(c, err, "")
 		return
 	}
 	c.IndentedJSON(200, teamconfigs)
 }
 
-func AddmyConfig(c *gin.Context) {
+func GetmyConfigByName(c *gin.Context) {
 	team := c.Params.ByName("Team")
-	configM := bson.M{}
-	err := c.BindJSON(&configM)
-	if err != nil {
-		message := fmt.Sprint(err)
-		if strings.Contains(message, "invalid character") || strings.Contains(message, "cannot unmarshal") {
-			message = "post body must be in json format"
-		} else {
-			apiuser, _, _ := c.Request.BasicAuth()
-			errmessage := fmt.Sprintf("Api User: %s,Method: %s, Stage: BindJSON, func: AddmyConfig, Message: %s", apiuser, c.Request.Method, message)
-			log.Println(errmessage)
-			message = "Unhandled exception. Please contact to Administrator"
-		}
-		c.IndentedJSON(424, httpresponse{Status: false, Message: message})
-		c.Abort()
+	name := c.Params.ByName("name")
+	config, err := ConfigFM.WithContext(RequestContext(c)).GetOne(bson.M{"Team": team, "Name": name})
+	if err != nil {
+		RespondError(c, err, fmt.Sprintf("no configuration found with name: %s", name))
 		return
 	}
-	err = AddConfigValidation(configM)
+	teamconfigs, err := ConverttoTeamConfigs([]bson.M{config})
 	if err != nil {
-		c.IndentedJSON(424, httpresponse{Status: false, Message: fmt.Sprintln(err)})
-		c.Abort()
+		RespondError(c, err, "")
 		return
 	}
-	configM["Team"] = team
+	c.Header("ETag", ETag(StoredRevision(config)))
+	c.IndentedJSON(200, teamconfigs[0])
+}
 
-	err = ConfigFM.Insert(configM)
+func GetmyConfigByID(c *gin.Context) {
+	team := c.Params.ByName("Team")
+	id := c.Params.ByName("id")
+	config, err := ConfigFM.WithContext(RequestContext(c)).GetOne(bson.M{"Team": team, "ID": id})
 	if err != nil {
-		message := fmt.Sprint(err)
-		if strings.Contains(message, "dup key") {
-			message = "Given Configuration Name already exist"
-		} else {
-			apiuser, _, _ := c.Request.BasicAuth()
-			errmessage := fmt.Sprintf("Api User: %s, Method: %s, Body: %s, Stage: AddTeamConfig, func: AddDocument, Message: %s", apiuser, c.Request.Method, configM, message)
-			log.Println(errmessage)
-			message = "Unhandled exception. Please contact to Administrator"
-		}
-		c.IndentedJSON(424, httpresponse{Status: false, Message: message})
-		c.Abort()
+		RespondError(c, err, fmt.Sprintf("no configuration found with id: %s", id))
 		return
 	}
-	configM["UpdateType"] = "Add"
-	configM["UpdateTime"] = time.Now()
-	err = CM.Do(configM)
+	teamconfigs, err := ConverttoTeamConfigs([]bson.M{config})
 	if err != nil {
-		log.Println(err)
-		c.IndentedJSON(424, httpresponse{Status: false, Message: "Cannot process request"})
-		c.Abort()
+		RespondError(c, err, "")
 		return
 	}
-	c.IndentedJSON(200, httpresponse{Status: true, Message: ""})
+	c.Header("ETag", ETag(StoredRevision(config)))
+	c.IndentedJSON(200, teamconfigs[0])
+}
+
+func AddmyConfig(c *gin.Context) {
+	team := c.Params.ByName("Team")
+	configM := bson.M{}
+	err := c.ShouldBindJSON(&configM)
+	if err != nil {
+		RespondError(c, Invalid(err), "post body must be in json format")
+		return
+	}
+	configM, message, err := CreateConfig(c, team, configM)
+	if err != nil {
+		RespondError(c, err, message)
+		return
+	}
+	c.IndentedJSON(200, httpresponse{Status: true, Message: "", ID: fmt.Sprint(configM["ID"])})
+}
+
+// CreateConfig stores a new configuration of the team, records and publishes the change; the returned message is meant for the client
+func CreateConfig(c *gin.Context, team string, configM bson.M) (bson.M, string, error) {
+	err := AddConfigValidation(configM)
+	if err != nil {
+		return nil, fmt.Sprint(err), Invalid(err)
+	}
+	configM["Team"] = team
+	configM["Revision"] = 1
+	configM["ID"] = NewConfigID()
+	exists, err := TeamExists(RequestContext(c), team)
+	if err != nil {
+		return nil, "", fmt.Errorf("GetTeam: %w", err)
+	}
+	if !exists {
+		return nil, fmt.Sprintf("no team found with name: %s", team), ErrNotFound
+	}
+	err = ConfigFM.WithContext(RequestContext(c)).Insert(configM)
+	if err != nil {
+		return nil, fmt.Sprintf("Given Configuration Name already exist in team %s", team), fmt.Errorf("AddTeamConfig: %w", err)
+	}
+	SetAuditChange(c, fmt.Sprint(configM["Name"]), nil, configM)
+	RecordConfigRevisionOrLog(c, configM, "Add")
+	c.Header("ETag", ETag(1))
+	return configM, "", PublishConfigChange(c, configM, "Add")
+}
+
+// GetConfigPrecondition reads the If-Match header of a configuration change, a missing header fails when it is required
+func GetConfigPrecondition(c *gin.Context) (int, bool, error) {
+	revision, hasIfMatch, err := GetIfMatch(c)
+	if err != nil {
+		return 0, false, Invalid(err)
+	}
+	if !hasIfMatch && GlobalConfig.RequireIfMatch {
+		return 0, false, fmt.Errorf("%w: If-Match header is required", ErrPreconditionRequired)
+	}
+	return revision, hasIfMatch, nil
+}
+
+const configChangedMessage = "configuration was changed since it was read. Please get it again and retry"
+
+const noChangeMessage = "no difference between given and stored configuration"
+
+// ConfigChanges returns the fields which an update with the given values would change in the stored configuration
+func ConfigChanges(stored bson.M, values bson.M) map[string]FieldChange {
+	updated := bson.M{}
+	for key, value := range stored {
+		updated[key] = value
+	}
+	for key, value := range values {
+		updated[key] = value
+	}
+	return DocumentDiff(stored, updated)
 }
 
 func SetmyConfig(c *gin.Context) {
 	team := c.Params.ByName("Team")
 	configM := bson.M{}
-	err := c.BindJSON(&configM)
-	if err != nil {
-		message := fmt.Sprint(err)
-		if strings.Contains(message, "invalid character") || strings.Contains(message, "cannot unmarshal") {
-			message = "post body must be in json format"
-		} else {
-			apiuser, _, _ := c.Request.BasicAuth()
-			errmessage := fmt.Sprintf("Api User: %s, Method: %s, Stage: BindJSON, func: SetmyConfig, Message: %s", apiuser, c.Request.Method, message)
-			log.Println(errmessage)
-			message = "Unhandled exception. Please contact to Administrator"
-		}
-		c.IndentedJSON(424, httpresponse{Status: false, Message: message})
-		c.Abort()
+	err := c.ShouldBindJSON(&configM)
+	if err != nil {
+		RespondError(c, Invalid(err), "post body must be in json format")
 		return
 	}
 	configM["Team"] = team
 	err = SetConfigValidate(configM)
 	if err != nil {
-		c.IndentedJSON(424, httpresponse{Status: false, Message: fmt.Sprintln(err)})
-		c.Abort()
+		RespondError(c, Invalid(err), fmt.Sprint(err))
+		return
+	}
+	config, changed, message, err := UpdateConfig(c, team, ConfigFilter(team, configM), configM)
+	if err != nil {
+		RespondError(c, err, message)
+		return
+	}
+	if !changed {
+		c.IndentedJSON(200, httpresponse{Status: true, Message: noChangeMessage, ID: fmt.Sprint(config["ID"])})
 		return
 	}
-	filter := bson.M{"Team": team, "Name": configM["Name"]}
+	c.IndentedJSON(200, httpresponse{Status: true, Message: "", ID: fmt.Sprint(config["ID"])})
+}
+
+// UpdateConfig applies the given fields to the configuration matching filter, honouring If-Match. It returns the stored
+// configuration and false when nothing would change, a changed Name renames the configuration
+func UpdateConfig(c *gin.Context, team string, filter bson.M, configM bson.M) (bson.M, bool, string, error) {
+	delete(configM, "Revision")
+	revision, hasIfMatch, err := GetConfigPrecondition(c)
+	if err != nil {
+		return nil, false, "", err
+	}
+	reference := ConfigReference(filter)
+	delete(configM, "ID")
+	if name, ok := configM["Name"]; ok && (name == nil || name == "") {
+		delete(configM, "Name")
+	}
 	update := bson.D{
 		{Key: "$set", Value: configM},
+		{Key: "$inc", Value: bson.M{"Revision": 1}},
+	}
+	storedConfig, err := ConfigFM.WithContext(RequestContext(c)).GetOne(filter)
+	if revision == AnyRevision && errors.Is(err, ErrNotFound) {
+		return nil, false, fmt.Sprintf("no configuration found with %s", reference), ErrPreconditionFailed
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil, false, fmt.Sprintf("no configuration found with %s", reference), fmt.Errorf("GetTeamConfig: %w", err)
 	}
-	updatedConfig, err := ConfigFM.UpdateAndGet(filter, update)
-	if err != nil {
-		message := fmt.Sprint(err)
-		if message == "no document found to update" {
-			message = fmt.Sprintf("no configuration found with name: %s", configM["Name"].(string))
-		} else if message == "nothing to update" {
-			message = "no difference between given and stored configuration"
-		} else {
-			apiuser, _, _ := c.Request.BasicAuth()
-			errmessage := fmt.Sprintf("Api User: %s, Method: %s, Body: %s, Stage: SetTeamConfig, func: SetGetDocument, Message: %s", apiuser, c.Request.Method, configM, message)
-			log.Println(errmessage)
-			message = "Unhandled exception. Please contact to Administrator"
+	if err != nil {
+		return nil, false, "", fmt.Errorf("GetTeamConfig: %w", err)
+	}
+	if hasIfMatch && revision != AnyRevision {
+		if StoredRevision(storedConfig) != revision {
+			return nil, false, configChangedMessage, ErrPreconditionFailed
 		}
-		c.IndentedJSON(424, httpresponse{Status: false, Message: message})
-		c.Abort()
-		return
+		filter["Revision"] = RevisionFilter(revision)
+	}
+	if len(ConfigChanges(storedConfig, configM)) == 0 {
+		c.Header("ETag", ETag(StoredRevision(storedConfig)))
+		return storedConfig, false, "", nil
 	}
-	updatedConfig["UpdateType"] = "Update"
-	updatedConfig["UpdateTime"] = time.Now()
-	err = CM.Do(updatedConfig)
+	updatedConfig, err := ConfigFM.WithContext(RequestContext(c)).UpdateAndGet(filter, update)
 	if err != nil {
-		log.Println(err)
-		c.IndentedJSON(424, httpresponse{Status: false, Message: "Cannot process request"})
-		c.Abort()
-		return
+		switch {
+		case hasIfMatch && errors.Is(err, ErrNotFound):
+			return nil, false, configChangedMessage, ErrPreconditionFailed
+		case errors.Is(err, ErrDuplicate):
+			return nil, false, fmt.Sprintf("Given Configuration Name already exist in team %s", team), err
+		case errors.Is(err, ErrNotFound):
+			return nil, false, fmt.Sprintf("no configuration found with %s", reference), fmt.Errorf("SetTeamConfig: %w", err)
+		}
+		return nil, false, "", fmt.Errorf("SetTeamConfig: %w", err)
 	}
-	c.IndentedJSON(200, httpresponse{Status: true, Message: ""})
+	SetAuditChange(c, fmt.Sprint(updatedConfig["Name"]), storedConfig, updatedConfig)
+	if storedConfig["Name"] != updatedConfig["Name"] {
+		// A renamed configuration keeps its ID and its revision history
+		err = RevisionFM.WithContext(RequestContext(c)).UpdateMany(bson.M{"Team": team, "Name": storedConfig["Name"]}, bson.D{{Key: "$set", Value: bson.M{"Name": updatedConfig["Name"]}}})
+		if err != nil {
+			RequestLogger(c).Error("cannot rename configuration revisions", "stage", "RenameConfigRevisions", "error", err)
+		}
+		updatedConfig["PreviousName"] = storedConfig["Name"]
+	}
+	RecordConfigRevisionOrLog(c, updatedConfig, "Update")
+	c.Header("ETag", ETag(StoredRevision(updatedConfig)))
+	return updatedConfig, true, "", PublishConfigChange(c, updatedConfig, "Update")
 }
 
 func RemovemyConfig(c *gin.Context) {
 	team := c.Params.ByName("Team")
 	configM := bson.M{}
-	err := c.BindJSON(&configM)
-	if err != nil {
-		message := fmt.Sprint(err)
-		if strings.Contains(message, "invalid character") || strings.Contains(message, "cannot unmarshal") {
-			message = "post body must be in json format"
-		} else {
-			apiuser, _, _ := c.Request.BasicAuth()
-			errmessage := fmt.Sprintf("Api User: %s, Method: %s, Stage: BindJSON, func: RemovemyConfig, Message: %s", apiuser, c.Request.Method, message)
-			log.Println(errmessage)
-			message = "Unhandled exception. Please contact to Administrator"
-		}
-		c.IndentedJSON(424, httpresponse{Status: false, Message: message})
-		c.Abort()
+	err := c.ShouldBindJSON(&configM)
+	if err != nil {
+		RespondError(c, Invalid(err), "post body must be in json format")
 		return
 	}
 	val, ok := configM["Name"]
-	if !ok || val == "" {
-		c.IndentedJSON(424, httpresponse{Status: false, Message: "Name field cannot be null or empty"})
-		c.Abort()
+	id, _ := configM["ID"].(string)
+	if (!ok || val == "") && id == "" {
+		RespondError(c, ErrInvalid, "Name or ID field cannot be null or empty")
 		return
 	}
-	filter := bson.M{"Name": configM["Name"]}
-	err = ConfigFM.Delete(filter)
+	message, err := DeleteConfig(c, team, ConfigFilter(team, configM), bson.M{"Team": team, "Name": configM["Name"], "ID": id})
 	if err != nil {
-		message := fmt.Sprint(err)
-		if message == "nothing to delete" {
-			message = fmt.Sprintf("There is no configuration with name: %s", configM["Name"].(string))
-		} else {
-			apiuser, _, _ := c.Request.BasicAuth()
-			errmessage := fmt.Sprintf("Api User: %s, Method: %s, Body: %s, Stage: RemoveTeamConfig, func: RemovemyConfig, Message: %s", apiuser, c.Request.Method, configM, message)
-			log.Println(errmessage)
-			message = "Unhandled exception. Please contact to Administrator"
-		}
-		c.IndentedJSON(424, httpresponse{Status: false, Message: message})
-		c.Abort()
+		RespondError(c, err, message)
 		return
 	}
 	c.IndentedJSON(200, httpresponse{Status: true, Message: ""})
-	configM["Team"] = team
-	configM["UpdateType"] = "Delete"
-	configM["UpdateTime"] = time.Now()
-	err = CM.Do(configM)
+}
+
+// DeleteConfig removes the configuration matching filter, honouring If-Match. removed describes the configuration
+// in the change event when it was already gone before the delete
+func DeleteConfig(c *gin.Context, team string, filter bson.M, removed bson.M) (string, error) {
+	revision, hasIfMatch, err := GetConfigPrecondition(c)
+	if err != nil {
+		return "", err
+	}
+	reference := ConfigReference(filter)
+	storedConfig, err := ConfigFM.WithContext(RequestContext(c)).GetOne(filter)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", fmt.Errorf("GetTeamConfig: %w", err)
+	}
+	if revision == AnyRevision && storedConfig == nil {
+		return fmt.Sprintf("There is no configuration with %s", reference), ErrPreconditionFailed
+	}
+	if hasIfMatch && revision != AnyRevision {
+		if StoredRevision(storedConfig) != revision {
+			return configChangedMessage, ErrPreconditionFailed
+		}
+		filter["Revision"] = RevisionFilter(revision)
+	}
+	err = ConfigFM.WithContext(RequestContext(c)).Delete(filter)
 	if err != nil {
-		log.Println(err)
-		c.IndentedJSON(424, httpresponse{Status: false, Message: "Cannot process request"})
-		c.Abort()
+		if hasIfMatch && storedConfig != nil && errors.Is(err, ErrNotFound) {
+			return configChangedMessage, ErrPreconditionFailed
+		}
+		return fmt.Sprintf("There is no configuration with %s", reference), fmt.Errorf("RemoveTeamConfig: %w", err)
+	}
+	if storedConfig == nil {
+		storedConfig = removed
+	}
+	SetAuditChange(c, fmt.Sprint(storedConfig["Name"]), storedConfig, nil)
+	RecordConfigRevisionOrLog(c, storedConfig, "Delete")
+	return "", PublishConfigChange(c, storedConfig, "Delete")
+}
+
+var userProjection = bson.M{"Password": 0, "PasswordHistory": 0}
+
+func GetApiUsers(c *gin.Context) {
+	list, message, err := ListUsers(c)
+	if err != nil {
+		RespondError(c, err, message)
 		return
 	}
+	c.IndentedJSON(200, list)
 }
 
-func AddApiUser(c *gin.Context) {
+// ListUsers returns a page of users, of every team for system users and of their own team otherwise
+func ListUsers(c *gin.Context) (userlist, string, error) {
 	isSystemAuthorized := c.Params.ByName("isAuthorized")
-	if isSystemAuthorized == "false" {
-		c.IndentedJSON(403, httpresponse{Status: false, Message: "Not authorized"})
-		return
+	team := c.Params.ByName("Team")
+	page, limit, err := GetPagination(c)
+	if err != nil {
+		return userlist{}, fmt.Sprint(err), Invalid(err)
 	}
-	user := bson.M{}
-	err := c.BindJSON(&user)
-	if err != nil {
-		message := fmt.Sprint(err)
-		if strings.Contains(message, "invalid character") || strings.Contains(message, "cannot unmarshal") {
-			message = "post body must be in json format"
-		} else {
-			apiuser, _, _ := c.Request.BasicAuth()
-			errmessage := fmt.Sprintf("Api User: %s, Method: %s, Stage: BindJSON, func: AddApiUser, Message: %s", apiuser, c.Request.Method, message)
-			log.Println(errmessage)
-			message = "Unhandled exception. Please contact to Administrator"
+	filter := bson.M{"Team": team}
+	if isSystemAuthorized != "false" {
+		filter = bson.M{}
+		if queryTeam := c.Query("team"); queryTeam != "" {
+			filter["Team"] = queryTeam
 		}
-		c.IndentedJSON(424, httpresponse{Status: false, Message: message})
-		c.Abort()
+	} else if queryTeam := c.Query("team"); queryTeam != "" && queryTeam != team {
+		return userlist{}, "Not authorized", ErrForbidden
+	}
+	findOptions := FindOptions{
+		Skip:       (page - 1) * limit,
+		Limit:      limit,
+		Sort:       bson.D{{Key: "Team", Value: 1}, {Key: "Name", Value: 1}},
+		Projection: userProjection,
+	}
+	users, total, err := UserFM.WithContext(RequestContext(c)).GetPage(filter, findOptions)
+	if err != nil {
+		return userlist{}, "", fmt.Errorf("GetTeamUsers: %w", err)
+	}
+	apiUsers, err := ConverttoApiUsers(users)
+	if err != nil {
+		return userlist{}, "", err
+	}
+	return userlist{Users: apiUsers, Total: total, Page: page, Limit: limit}, "", nil
+}
+
+func GetApiUser(c *gin.Context) {
+	isSystemAuthorized := c.Params.ByName("isAuthorized")
+	team := c.Params.ByName("Team")
+	name := c.Params.ByName("name")
+	filter := bson.M{"Name": name}
+	if isSystemAuthorized == "false" {
+		filter["Team"] = team
+	}
+	users, _, err := UserFM.WithContext(RequestContext(c)).GetPage(filter, FindOptions{Limit: 1, Projection: userProjection})
+	if err != nil {
+		RespondError(c, fmt.Errorf("GetTeamUser: %w", err), "")
 		return
 	}
-	err = AddUserValidation(user)
+	apiUsers, err := ConverttoApiUsers(users)
 	if err != nil {
-		c.IndentedJSON(424, httpresponse{Status: false, Message: fmt.Sprintln(err)})
+		RespondError(c, err, "")
 		return
 	}
-	pwdCheck := PasswordComplexityCheck(user["Password"].(string))
-	if !pwdCheck {
-		c.IndentedJSON(424, httpresponse{Status: false, Message: "Provided password doesn't meet required complexity. Please see documentation"})
+	if len(apiUsers) == 0 {
+		RespondError(c, ErrNotFound, fmt.Sprintf("no user found with name: %s", name))
 		return
 	}
-	user["Password"] = GetHash(user["Password"].(string))
-	err = UserFM.Insert(user)
+	c.IndentedJSON(200, apiUsers[0])
+}
+
+func AddApiUser(c *gin.Context) {
+	isSystemAuthorized := c.Params.ByName("isAuthorized")
+	if isSystemAuthorized == "false" {
+		RespondError(c, ErrForbidden, "Not authorized")
+		return
+	}
+	user := bson.M{}
+	err := c.ShouldBindJSON(&user)
 	if err != nil {
-		message := fmt.Sprint(err)
-		if strings.Contains(message, "dup key") {
-			message = fmt.Sprintf("There is already have user with name %s", user["Name"])
-		} else {
-			apiuser, _, _ := c.Request.BasicAuth()
-			errmessage := fmt.Sprintf("Api User: %s, Method: %s, Stage: AddTeamUser, func: AddApiUser, Message: %s", apiuser, c.Request.Method, message)
-			log.Println(errmessage)
-			message = "Unhandled exception. Please contact to Administrator"
-		}
-		c.IndentedJSON(424, httpresponse{Status: false, Message: message})
+		RespondError(c, Invalid(err), "post body must be in json format")
+		return
+	}
+	message, err := CreateUser(c, user)
+	if err != nil {
+		RespondError(c, err, message)
 		return
 	}
 	c.IndentedJSON(200, httpresponse{Status: true, Message: ""})
 }
 
+// CreateUser stores a new account with the hash of its password
+func CreateUser(c *gin.Context, user bson.M) (string, error) {
+	err := AddUserValidation(user)
+	if err != nil {
+		return fmt.Sprint(err), Invalid(err)
+	}
+	userTeam, _ := user["Team"].(string)
+	exists, err := TeamExists(RequestContext(c), userTeam)
+	if err != nil {
+		return "", fmt.Errorf("GetTeam: %w", err)
+	}
+	if !exists {
+		return fmt.Sprintf("no team found with name: %s", userTeam), ErrNotFound
+	}
+	password, _ := user["Password"].(string)
+	userName, _ := user["Name"].(string)
+	if failed := GlobalConfig.PasswordPolicy.Check(password, userName); len(failed) > 0 {
+		return PasswordPolicyMessage(failed), ErrInvalid
+	}
+	user["Password"] = GetHash(password)
+	user["PasswordCreated"] = time.Now()
+	user["PasswordHistory"] = []string{}
+	mustChange, _ := user["MustChangePassword"].(bool)
+	user["MustChangePassword"] = mustChange
+	err = UserFM.WithContext(RequestContext(c)).Insert(user)
+	if err != nil {
+		return fmt.Sprintf("There is already have user with name %s", user["Name"]), fmt.Errorf("AddTeamUser: %w", err)
+	}
+	SetAuditChange(c, userName, nil, user)
+	return "", nil
+}
+
 func SetApiUser(c *gin.Context) {
-	isSystemAuthorized := c.Params.ByName("isAuthorized")
-	userName, _, _ := c.Request.BasicAuth()
 	user := bson.M{}
-	err := c.BindJSON(&user)
-	if err != nil {
-		message := fmt.Sprint(err)
-		if strings.Contains(message, "invalid character") || strings.Contains(message, "cannot unmarshal") {
-			message = "post body must be in json format"
-		} else {
-			apiuser, _, _ := c.Request.BasicAuth()
-			errmessage := fmt.Sprintf("Api User: %s, Method: %s, Stage: BindJSON, func: SetApiUser, Message: %s", apiuser, c.Request.Method, message)
-			log.Println(errmessage)
-			message = "Unhandled exception. Please contact to Administrator"
-		}
-		c.IndentedJSON(424, httpresponse{Status: false, Message: message})
+	err := c.ShouldBindJSON(&user)
+	if err != nil {
+		RespondError(c, Invalid(err), "post body must be in json format")
 		return
 	}
 	if _, ok := user["Name"]; !ok || user["Name"] == "" {
-		user["Name"] = userName
-	} else if user["Name"] != userName && isSystemAuthorized == "false" {
-		c.IndentedJSON(403, httpresponse{Status: false, Message: "You don't have permissions for this change"})
-		return
+		user["Name"] = GetUserName(c)
 	}
-	_, ok := user["Password"]
-	pwdCheck := false
-	if ok {
-		pwdCheck = PasswordComplexityCheck(user["Password"].(string))
+	changed, message, err := UpdateUser(c, user)
+	if err != nil {
+		RespondError(c, err, message)
+		return
 	}
-	if !pwdCheck {
-		c.IndentedJSON(424, httpresponse{Status: false, Message: "Provided password doesn't meet required complexity. Please see documentation"})
+	if !changed {
+		c.IndentedJSON(200, httpresponse{Status: true, Message: "no difference between given and stored user"})
 		return
 	}
-	user["Password"] = GetHash(user["Password"].(string))
+	c.IndentedJSON(200, httpresponse{Status: true, Message: ""})
+}
+
+// UpdateUser changes the password or the MustChangePassword flag of the named user, users other than system ones
+// may only change their own password. It returns false when the stored user already has the given flag
+func UpdateUser(c *gin.Context, user bson.M) (bool, string, error) {
+	isSystemAuthorized := c.Params.ByName("isAuthorized")
+	userName := GetUserName(c)
+	if user["Name"] != userName && isSystemAuthorized == "false" {
+		return false, "You don't have permissions for this change", ErrForbidden
+	}
 	filter := bson.M{"Name": user["Name"]}
-	update := bson.D{
-		{Key: "$set", Value: bson.M{"Password": user["Password"]}},
-	}
-	err = UserFM.Update(filter, update)
-	if err != nil {
-		message := fmt.Sprint(err)
-		if message == "no document found to update" {
-			message = fmt.Sprintf("no user found with name: %s", user["Name"].(string))
-		} else if message == "nothing to update" {
-			message = "same password provided"
-		} else {
-			apiuser, _, _ := c.Request.BasicAuth()
-			errmessage := fmt.Sprintf("Api User: %s, Method: %s, Body: %s, Stage: SetTeamUser, func: SetApiUser, Message: %s", apiuser, c.Request.Method, user, message)
-			log.Println(errmessage)
-			message = "Unhandled exception. Please contact to Administrator"
+	mustChange, mustChangeProvided := user["MustChangePassword"].(bool)
+	if mustChangeProvided && isSystemAuthorized == "false" {
+		if mustChange {
+			return false, "You don't have permissions for this change", ErrForbidden
 		}
-		c.IndentedJSON(424, httpresponse{Status: false, Message: message})
-		c.Abort()
-		return
+		// A false flag is what changing the own password sets anyway, it must not clear a pending change on its own
+		mustChangeProvided = false
 	}
-	c.IndentedJSON(200, httpresponse{Status: true, Message: ""})
+	password, ok := user["Password"].(string)
+	if !ok && mustChangeProvided {
+		update := bson.D{
+			{Key: "$set", Value: bson.M{"MustChangePassword": mustChange}},
+		}
+		err := UserFM.WithContext(RequestContext(c)).Update(filter, update)
+		if errors.Is(err, ErrNoChange) {
+			return false, "", nil
+		}
+		if err != nil {
+			return false, fmt.Sprintf("no user found with name: %s", user["Name"]), fmt.Errorf("SetTeamUser: %w", err)
+		}
+		SetAuditChange(c, fmt.Sprint(user["Name"]), nil, bson.M{"MustChangePassword": mustChange})
+		return true, "", nil
+	}
+	if !ok {
+		return false, "Password field cannot be null", ErrInvalid
+	}
+	targetName, _ := user["Name"].(string)
+	if failed := GlobalConfig.PasswordPolicy.Check(password, targetName); len(failed) > 0 {
+		return false, PasswordPolicyMessage(failed), ErrInvalid
+	}
+	storedUser, err := UserFM.WithContext(RequestContext(c)).GetOne(filter)
+	if err != nil {
+		return false, fmt.Sprintf("no user found with name: %s", targetName), fmt.Errorf("GetTeamUser: %w", err)
+	}
+	hash := GetHash(password)
+	if GlobalConfig.PasswordPolicy.IsReused(storedUser, hash) {
+		return false, "Provided password was used recently. Please choose another one", ErrInvalid
+	}
+	// Password reset by an administrator for someone else must be changed by the owner at next login
+	if !mustChangeProvided {
+		mustChange = targetName != userName
+	}
+	changes := bson.M{
+		"Password":           hash,
+		"PasswordCreated":    time.Now(),
+		"PasswordHistory":    GlobalConfig.PasswordPolicy.NextHistory(storedUser),
+		"MustChangePassword": mustChange,
+	}
+	update := bson.D{
+		{Key: "$set", Value: changes},
+	}
+	err = UserFM.WithContext(RequestContext(c)).Update(filter, update)
+	if err != nil {
+		return false, fmt.Sprintf("no user found with name: %s", targetName), fmt.Errorf("SetTeamUser: %w", err)
+	}
+	updatedUser := bson.M{}
+	for key, value := range storedUser {
+		updatedUser[key] = value
+	}
+	for key, value := range changes {
+		updatedUser[key] = value
+	}
+	SetAuditChange(c, targetName, storedUser, updatedUser)
+	return true, "", nil
 }
 
 func RemoveApiUser(c *gin.Context) {
 	isSystemAuthorized := c.Params.ByName("isAuthorized")
 	if isSystemAuthorized == "false" {
-		c.IndentedJSON(403, httpresponse{Status: false, Message: "Not authorized"})
+		RespondError(c, ErrForbidden, "Not authorized")
 		return
 	}
 	user := bson.M{}
-	if err := c.BindJSON(&user); err != nil {
-		message := fmt.Sprint(err)
-		if strings.Contains(message, "invalid character") || strings.Contains(message, "cannot unmarshal") {
-			message = "post body must be in json format"
-		} else {
-			apiuser, _, _ := c.Request.BasicAuth()
-			errmessage := fmt.Sprintf("Api User: %s, Method: %s, Stage: BindJSON, func: RemoveApiUser, Message: %s", apiuser, c.Request.Method, message)
-			log.Println(errmessage)
-			message = "Unhandled exception. Please contact to Administrator"
-		}
-		c.IndentedJSON(424, httpresponse{Status: false, Message: message})
+	if err := c.ShouldBindJSON(&user); err != nil {
+		RespondError(c, Invalid(err), "post body must be in json format")
 		return
 	}
 	val, ok := user["Name"]
 	if !ok || val == "" {
-		c.IndentedJSON(424, httpresponse{Status: false, Message: "Name field cannot be null"})
+		RespondError(c, ErrInvalid, "Name field cannot be null")
 		return
 	}
-	filter := bson.M{"Name": user["Name"]}
-	err := UserFM.Delete(filter)
-	if err != nil {
-		message := fmt.Sprint(err)
-		if message == "nothing to delete" {
-			message = fmt.Sprintf("no user found with name: %s", user["Name"].(string))
-		} else {
-			apiuser, _, _ := c.Request.BasicAuth()
-			errmessage := fmt.Sprintf("Api User: %s, Method: %s, Body: %s, Stage: RemoveTeamUser, func: RemoveApiUser, Message: %s", apiuser, c.Request.Method, user, message)
-			log.Println(errmessage)
-			message = "Unhandled exception. Please contact to Administrator"
-		}
-		c.IndentedJSON(424, httpresponse{Status: false, Message: message})
+	if message, err := DeleteUser(c, user["Name"]); err != nil {
+		RespondError(c, err, message)
 		return
 	}
 	c.IndentedJSON(200, httpresponse{Status: true, Message: ""})
 }
+
+func DeleteUser(c *gin.Context, name interface{}) (string, error) {
+	filter := bson.M{"Name": name}
+	storedUser, _ := UserFM.WithContext(RequestContext(c)).GetOne(filter)
+	err := UserFM.WithContext(RequestContext(c)).Delete(filter)
+	if err != nil {
+		return fmt.Sprintf("no user found with name: %s", name), fmt.Errorf("RemoveTeamUser: %w", err)
+	}
+	SetAuditChange(c, fmt.Sprint(name), storedUser, nil)
+	return "", nil
+}